@@ -72,10 +72,10 @@ func (b *blkioController) Create(path string, resources *specs.LinuxResources) e
 	}
 	for _, t := range createBlkioSettings(resources.BlockIO) {
 		if t.value != nil {
-			if err := os.WriteFile(
-				filepath.Join(b.Path(path), "blkio."+t.name),
+			if err := writeFile(
+				b.Path(path),
+				"blkio."+t.name,
 				t.format(t.value),
-				defaultFilePerm,
 			); err != nil {
 				return err
 			}
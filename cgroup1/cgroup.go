@@ -28,6 +28,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/containerd/cgroups/v3"
 	v1 "github.com/containerd/cgroups/v3/cgroup1/stats"
 
 	"github.com/opencontainers/runtime-spec/specs-go"
@@ -235,13 +236,14 @@ func (c *cgroup) add(process Process, pType procType, subsystems ...Name) error
 		if err != nil {
 			return err
 		}
+		pid := strconv.Itoa(process.Pid)
 		err = writeCgroupProcs(
 			filepath.Join(s.Path(p), pType),
-			[]byte(strconv.Itoa(process.Pid)),
+			[]byte(pid),
 			defaultFilePerm,
 		)
 		if err != nil {
-			return err
+			return cgroups.NewError("write", s.Path(p), pType, pid, err)
 		}
 	}
 	return nil
@@ -254,7 +256,10 @@ func (c *cgroup) Delete() error {
 	if c.err != nil {
 		return c.err
 	}
-	var errs []string
+	var (
+		errs     []string
+		firstErr error
+	)
 	for _, s := range c.subsystems {
 		// kernel prevents cgroups with running process from being removed, check the tree is empty
 		procs, err := c.processes(s.Name(), true, cgroupProcs)
@@ -267,6 +272,9 @@ func (c *cgroup) Delete() error {
 		}
 		if len(procs) > 0 {
 			errs = append(errs, fmt.Sprintf("%s (contains running processes)", string(s.Name())))
+			if firstErr == nil {
+				firstErr = syscall.EBUSY
+			}
 			continue
 		}
 		if d, ok := s.(deleter); ok {
@@ -276,6 +284,9 @@ func (c *cgroup) Delete() error {
 			}
 			if err := d.Delete(sp); err != nil {
 				errs = append(errs, string(s.Name()))
+				if firstErr == nil {
+					firstErr = err
+				}
 			}
 			continue
 		}
@@ -287,12 +298,15 @@ func (c *cgroup) Delete() error {
 			path := p.Path(sp)
 			if err := remove(path); err != nil {
 				errs = append(errs, path)
+				if firstErr == nil {
+					firstErr = err
+				}
 			}
 			continue
 		}
 	}
 	if len(errs) > 0 {
-		return fmt.Errorf("cgroups: unable to remove paths %s", strings.Join(errs, ", "))
+		return fmt.Errorf("cgroups: unable to remove paths %s: %w", strings.Join(errs, ", "), firstErr)
 	}
 	c.err = ErrCgroupDeleted
 	return nil
@@ -381,6 +395,29 @@ func (c *cgroup) Processes(subsystem Name, recursive bool) ([]Process, error) {
 	return c.processes(subsystem, recursive, cgroupProcs)
 }
 
+// ProcessesInfo returns the details of the processes running inside control,
+// as read from /proc, along with the path of the cgroup they live in. Processes
+// that exit while the cgroup is scanned are left out.
+func ProcessesInfo(control Cgroup, subsystem Name, recursive bool) ([]*cgroups.ProcessInfo, error) {
+	processes, err := control.Processes(subsystem, recursive)
+	if err != nil {
+		return nil, err
+	}
+	var infos []*cgroups.ProcessInfo
+	for _, p := range processes {
+		info, err := cgroups.ReadProcessInfo(p.Pid)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		info.Path = p.Path
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
 // Tasks returns the tasks running inside the cgroup along
 // with the subsystem used, pid, and path
 func (c *cgroup) Tasks(subsystem Name, recursive bool) ([]Task, error) {
@@ -534,17 +571,50 @@ func (c *cgroup) MoveTo(destination Cgroup) error {
 		return c.err
 	}
 	for _, s := range c.subsystems {
-		processes, err := c.processes(s.Name(), true, cgroupProcs)
-		if err != nil {
+		if err := c.moveSubsystem(s.Name(), destination); err != nil {
 			return err
 		}
-		for _, p := range processes {
-			if err := destination.Add(p); err != nil {
-				if strings.Contains(err.Error(), "no such process") {
-					continue
-				}
-				return err
+	}
+	return nil
+}
+
+// moveSubsystem moves the processes of a single subsystem to destination. The
+// processes are pinned with pidfds and checked to still be part of the cgroup
+// before they are moved, so that a recycled pid doesn't move an unrelated process.
+func (c *cgroup) moveSubsystem(subsystem Name, destination Cgroup) error {
+	processes, err := c.processes(subsystem, true, cgroupProcs)
+	if err != nil {
+		return err
+	}
+	pidsOf := func(processes []Process) []int {
+		pids := make([]int, len(processes))
+		for i, p := range processes {
+			pids[i] = p.Pid
+		}
+		return pids
+	}
+	handles, err := cgroups.OpenProcesses(pidsOf(processes), func() ([]int, error) {
+		processes, err := c.processes(subsystem, true, cgroupProcs)
+		if err != nil {
+			return nil, err
+		}
+		return pidsOf(processes), nil
+	})
+	if err != nil {
+		return err
+	}
+	defer cgroups.CloseProcesses(handles)
+	for _, h := range handles {
+		// skip processes that exited since they were verified, their pid
+		// may already belong to another process
+		if err := h.Signal(0); err != nil {
+			continue
+		}
+		if err := destination.Add(Process{Subsystem: subsystem, Pid: h.Pid()}); err != nil {
+			if errors.Is(err, syscall.ESRCH) {
+				continue
 			}
+			return err
 		}
 	}
 	return nil
@@ -285,6 +285,43 @@ func TestListPids(t *testing.T) {
 	}
 }
 
+func TestListProcessesInfo(t *testing.T) {
+	mock, err := newMock(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := mock.delete(); err != nil {
+			t.Errorf("failed delete: %v", err)
+		}
+	}()
+	control, err := New(StaticPath("test"), &specs.LinuxResources{}, WithHierarchy(mock.hierarchy))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	pid := os.Getpid()
+	if err := control.Add(Process{Pid: pid}); err != nil {
+		t.Error(err)
+		return
+	}
+	infos, err := ProcessesInfo(control, Freezer, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if l := len(infos); l != 1 {
+		t.Errorf("should have one process but received %d", l)
+		return
+	}
+	if infos[0].Pid != pid {
+		t.Errorf("expected pid %d but received %d", pid, infos[0].Pid)
+	}
+	if expected := filepath.Join(mock.root, string(Freezer), "test"); filepath.Clean(infos[0].Path) != expected {
+		t.Errorf("expected path %q but received %q", expected, infos[0].Path)
+	}
+}
+
 func TestListTasksPids(t *testing.T) {
 	mock, err := newMock(t)
 	if err != nil {
@@ -332,6 +369,47 @@ func readValue(mock *mockCgroup, path string) (string, error) {
 	return string(data), nil
 }
 
+func TestMoveToSkipsExitedPids(t *testing.T) {
+	mock, err := newMock(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := mock.delete(); err != nil {
+			t.Errorf("failed delete: %v", err)
+		}
+	}()
+	control, err := New(StaticPath("test"), &specs.LinuxResources{}, WithHierarchy(mock.hierarchy))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	destination, err := New(StaticPath("dest"), &specs.LinuxResources{}, WithHierarchy(mock.hierarchy))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the second pid is above any pid_max and can't belong to a process
+	pid := os.Getpid()
+	procs := []byte(fmt.Sprintf("%d\n%d\n", pid, 1<<30))
+	for _, s := range Subsystems() {
+		if err := os.WriteFile(filepath.Join(mock.root, string(s), "test", cgroupProcs), procs, defaultFilePerm); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if err := control.MoveTo(destination); err != nil {
+		t.Error(err)
+		return
+	}
+	for _, s := range Subsystems() {
+		if err := checkPid(mock, filepath.Join(string(s), "dest"), pid); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
 func checkPid(mock *mockCgroup, path string, expected int) error {
 	data, err := readValue(mock, filepath.Join(path, cgroupProcs))
 	if err != nil {
@@ -82,10 +82,10 @@ func (c *cpuController) Create(path string, resources *specs.LinuxResources) err
 				value = []byte(strconv.FormatInt(*t.ivalue, 10))
 			}
 			if value != nil {
-				if err := os.WriteFile(
-					filepath.Join(c.Path(path), "cpu."+t.name),
+				if err := writeFile(
+					c.Path(path),
+					"cpu."+t.name,
 					value,
-					defaultFilePerm,
 				); err != nil {
 					return err
 				}
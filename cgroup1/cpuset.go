@@ -68,10 +68,10 @@ func (c *cpusetController) Create(path string, resources *specs.LinuxResources)
 			},
 		} {
 			if t.value != "" {
-				if err := os.WriteFile(
-					filepath.Join(c.Path(path), "cpuset."+t.name),
+				if err := writeFile(
+					c.Path(path),
+					"cpuset."+t.name,
 					[]byte(t.value),
-					defaultFilePerm,
 				); err != nil {
 					return err
 				}
@@ -133,19 +133,19 @@ func (c *cpusetController) copyIfNeeded(current, parent string) error {
 		return err
 	}
 	if isEmpty(currentCpus) {
-		if err := os.WriteFile(
-			filepath.Join(current, "cpuset.cpus"),
+		if err := writeFile(
+			current,
+			"cpuset.cpus",
 			parentCpus,
-			defaultFilePerm,
 		); err != nil {
 			return err
 		}
 	}
 	if isEmpty(currentMems) {
-		if err := os.WriteFile(
-			filepath.Join(current, "cpuset.mems"),
+		if err := writeFile(
+			current,
+			"cpuset.mems",
 			parentMems,
-			defaultFilePerm,
 		); err != nil {
 			return err
 		}
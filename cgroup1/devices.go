@@ -60,10 +60,10 @@ func (d *devicesController) Create(path string, resources *specs.LinuxResources)
 		if device.Type == "" {
 			device.Type = "a"
 		}
-		if err := os.WriteFile(
-			filepath.Join(d.Path(path), file),
+		if err := writeFile(
+			d.Path(path),
+			file,
 			[]byte(deviceString(device)),
-			defaultFilePerm,
 		); err != nil {
 			return err
 		}
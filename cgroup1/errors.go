@@ -19,15 +19,17 @@ package cgroup1
 import (
 	"errors"
 	"os"
+
+	"github.com/containerd/cgroups/v3"
 )
 
 var (
 	ErrInvalidPid               = errors.New("cgroups: pid must be greater than 0")
 	ErrMountPointNotExist       = errors.New("cgroups: cgroup mountpoint does not exist")
-	ErrInvalidFormat            = errors.New("cgroups: parsing file with invalid format failed")
-	ErrFreezerNotSupported      = errors.New("cgroups: freezer cgroup not supported on this system")
-	ErrMemoryNotSupported       = errors.New("cgroups: memory cgroup not supported on this system")
-	ErrCgroupDeleted            = errors.New("cgroups: cgroup deleted")
+	ErrInvalidFormat            = cgroups.ErrInvalidFormat
+	ErrFreezerNotSupported      = cgroups.ErrFreezerNotSupported
+	ErrMemoryNotSupported       = cgroups.ErrMemoryNotSupported
+	ErrCgroupDeleted            = cgroups.ErrCgroupDeleted
 	ErrNoCgroupMountDestination = errors.New("cgroups: cannot find cgroup mount destination")
 )
 
@@ -36,7 +38,7 @@ type ErrorHandler func(err error) error
 
 // IgnoreNotExist ignores any errors that are for not existing files
 func IgnoreNotExist(err error) error {
-	if os.IsNotExist(err) {
+	if errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
 	return err
@@ -45,3 +47,7 @@ func IgnoreNotExist(err error) error {
 func errPassthrough(err error) error {
 	return err
 }
+
+// Error is returned when an operation on a cgroup, or on one of its files,
+// fails, see cgroups.Error.
+type Error = cgroups.Error
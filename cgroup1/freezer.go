@@ -50,10 +50,10 @@ func (f *freezerController) Thaw(path string) error {
 }
 
 func (f *freezerController) changeState(path string, state State) error {
-	return os.WriteFile(
-		filepath.Join(f.root, path, "freezer.state"),
+	return writeFile(
+		filepath.Join(f.root, path),
+		"freezer.state",
 		[]byte(strings.ToUpper(string(state))),
-		defaultFilePerm,
 	)
 }
 
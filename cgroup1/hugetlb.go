@@ -56,10 +56,10 @@ func (h *hugetlbController) Create(path string, resources *specs.LinuxResources)
 		return err
 	}
 	for _, limit := range resources.HugepageLimits {
-		if err := os.WriteFile(
-			filepath.Join(h.Path(path), strings.Join([]string{"hugetlb", limit.Pagesize, "limit_in_bytes"}, ".")),
+		if err := writeFile(
+			h.Path(path),
+			strings.Join([]string{"hugetlb", limit.Pagesize, "limit_in_bytes"}, "."),
 			[]byte(strconv.FormatUint(limit.Limit, 10)),
-			defaultFilePerm,
 		); err != nil {
 			return err
 		}
@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/containerd/cgroups/v3"
 	v1 "github.com/containerd/cgroups/v3/cgroup1/stats"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sys/unix"
@@ -394,10 +395,10 @@ func (m *memoryController) parseOomControlStats(r io.Reader, stat *v1.MemoryOomC
 func (m *memoryController) set(path string, settings []memorySettings) error {
 	for _, t := range settings {
 		if t.value != nil {
-			if err := os.WriteFile(
-				filepath.Join(m.Path(path), "memory."+t.name),
+			if err := writeFile(
+				m.Path(path),
+				"memory."+t.name,
 				[]byte(strconv.FormatInt(*t.value, 10)),
-				defaultFilePerm,
 			); err != nil {
 				return err
 			}
@@ -477,7 +478,7 @@ func (m *memoryController) memoryEvent(path string, event MemoryEvent) (uintptr,
 	evctlPath := filepath.Join(root, "cgroup.event_control")
 	if err := os.WriteFile(evctlPath, []byte(data), 0o700); err != nil {
 		unix.Close(efd)
-		return 0, err
+		return 0, cgroups.NewError("write", root, "cgroup.event_control", data, err)
 	}
 	return uintptr(efd), nil
 }
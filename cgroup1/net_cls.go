@@ -47,10 +47,10 @@ func (n *netclsController) Create(path string, resources *specs.LinuxResources)
 		return err
 	}
 	if resources.Network != nil && resources.Network.ClassID != nil && *resources.Network.ClassID > 0 {
-		return os.WriteFile(
-			filepath.Join(n.Path(path), "net_cls.classid"),
+		return writeFile(
+			n.Path(path),
+			"net_cls.classid",
 			[]byte(strconv.FormatUint(uint64(*resources.Network.ClassID), 10)),
-			defaultFilePerm,
 		)
 	}
 	return nil
@@ -48,10 +48,10 @@ func (n *netprioController) Create(path string, resources *specs.LinuxResources)
 	}
 	if resources.Network != nil {
 		for _, prio := range resources.Network.Priorities {
-			if err := os.WriteFile(
-				filepath.Join(n.Path(path), "net_prio.ifpriomap"),
+			if err := writeFile(
+				n.Path(path),
+				"net_prio.ifpriomap",
 				formatPrio(prio.Name, prio.Priority),
-				defaultFilePerm,
 			); err != nil {
 				return err
 			}
@@ -48,10 +48,10 @@ func (p *pidsController) Create(path string, resources *specs.LinuxResources) er
 		return err
 	}
 	if resources.Pids != nil && resources.Pids.Limit > 0 {
-		return os.WriteFile(
-			filepath.Join(p.Path(path), "pids.max"),
+		return writeFile(
+			p.Path(path),
+			"pids.max",
 			[]byte(strconv.FormatInt(resources.Pids.Limit, 10)),
-			defaultFilePerm,
 		)
 	}
 	return nil
@@ -67,10 +67,10 @@ func (p *rdmaController) Create(path string, resources *specs.LinuxResources) er
 	for device, limit := range resources.Rdma {
 		if device != "" && (limit.HcaHandles != nil || limit.HcaObjects != nil) {
 			limit := limit
-			return os.WriteFile(
-				filepath.Join(p.Path(path), "rdma.max"),
+			return writeFile(
+				p.Path(path),
+				"rdma.max",
 				[]byte(createCmdString(device, &limit)),
-				defaultFilePerm,
 			)
 		}
 	}
@@ -18,10 +18,12 @@ package cgroup1
 
 import (
 	"context"
+	"errors"
 	"path/filepath"
 	"strings"
 	"sync"
 
+	"github.com/containerd/cgroups/v3"
 	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
 	"github.com/godbus/dbus/v5"
 	specs "github.com/opencontainers/runtime-spec/specs-go"
@@ -37,7 +39,7 @@ var (
 	once        sync.Once
 )
 
-func Systemd() ([]Subsystem, error) {
+func Systemd(opts ...SystemdOpts) ([]Subsystem, error) {
 	root, err := v1MountPoint()
 	if err != nil {
 		return nil, err
@@ -46,7 +48,7 @@ func Systemd() ([]Subsystem, error) {
 	if err != nil {
 		return nil, err
 	}
-	s, err := NewSystemd(root)
+	s, err := NewSystemd(root, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -54,23 +56,91 @@ func Systemd() ([]Subsystem, error) {
 	return append([]Subsystem{s}, defaultSubsystems...), nil
 }
 
+// Slice returns the path of the unit name in slice, the dashes in the slice
+// name being expanded to its parent slices like systemd does. A name without
+// a unit type suffix, like "runc-test", is the name of a scope. The path
+// function returns an *cgroups.InvalidUnitNameError when systemd would reject
+// the names.
 func Slice(slice, name string) Path {
 	if slice == "" {
 		slice = string(defaultSlice)
 	}
+	if cgroups.ValidateUnitName(name) != nil && cgroups.ValidateUnitName(name+".scope") == nil {
+		name += ".scope"
+	}
 	return func(subsystem Name) (string, error) {
-		return filepath.Join(slice, name), nil
+		parent := "/"
+		if slice != "/" {
+			var err error
+			if parent, err = cgroups.ExpandSlice(slice); err != nil {
+				return "", err
+			}
+		}
+		if err := cgroups.ValidateUnitName(name); err != nil {
+			return "", err
+		}
+		return filepath.Join(parent, name), nil
+	}
+}
+
+// SystemdOpts configure the connection of a SystemdController to systemd.
+type SystemdOpts func(*SystemdController) error
+
+// WithSystemdUserBus makes the controller talk to the systemd instance of the
+// user, over the session bus, instead of the system instance.
+func WithSystemdUserBus() SystemdOpts {
+	return func(s *SystemdController) error {
+		s.connect = systemdDbus.NewUserConnectionContext
+		return nil
+	}
+}
+
+// WithSystemdConn makes the controller use conn, which is never closed by the
+// controller.
+func WithSystemdConn(conn *systemdDbus.Conn) SystemdOpts {
+	return func(s *SystemdController) error {
+		if conn == nil {
+			return errors.New("systemd connection is nil")
+		}
+		s.conn = conn
+		return nil
 	}
 }
 
-func NewSystemd(root string) (*SystemdController, error) {
-	return &SystemdController{
+func NewSystemd(root string, opts ...SystemdOpts) (*SystemdController, error) {
+	s := &SystemdController{
 		root: root,
-	}, nil
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 type SystemdController struct {
 	root string
+	// connect connects to the system instance when nil
+	connect func(ctx context.Context) (*systemdDbus.Conn, error)
+	// conn is a connection owned by the caller
+	conn *systemdDbus.Conn
+}
+
+// dial returns a connection to systemd and the function releasing it
+func (s *SystemdController) dial(ctx context.Context) (*systemdDbus.Conn, func(), error) {
+	if s.conn != nil {
+		return s.conn, func() {}, nil
+	}
+	connect := s.connect
+	if connect == nil {
+		connect = systemdDbus.NewWithContext
+	}
+	conn, err := connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, conn.Close, nil
 }
 
 func (s *SystemdController) Name() Name {
@@ -79,11 +149,11 @@ func (s *SystemdController) Name() Name {
 
 func (s *SystemdController) Create(path string, _ *specs.LinuxResources) error {
 	ctx := context.TODO()
-	conn, err := systemdDbus.NewWithContext(ctx)
+	conn, release, err := s.dial(ctx)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
+	defer release()
 	slice, name := splitName(path)
 	// We need to see if systemd can handle the delegate property
 	// Systemd will return an error if it cannot handle delegate regardless
@@ -129,11 +199,11 @@ func (s *SystemdController) Create(path string, _ *specs.LinuxResources) error {
 
 func (s *SystemdController) Delete(path string) error {
 	ctx := context.TODO()
-	conn, err := systemdDbus.NewWithContext(ctx)
+	conn, release, err := s.dial(ctx)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
+	defer release()
 	_, name := splitName(path)
 	ch := make(chan string)
 	_, err = conn.StopUnitContext(ctx, name, "replace", ch)
@@ -151,7 +221,13 @@ func newProperty(name string, units interface{}) systemdDbus.Property {
 	}
 }
 
+// splitName returns the unit of path and the slice it belongs to, which is the
+// last element of the expanded slice path.
 func splitName(path string) (slice string, unit string) {
 	slice, unit = filepath.Split(path)
-	return strings.TrimSuffix(slice, "/"), unit
+	slice = strings.TrimSuffix(slice, "/")
+	if i := strings.LastIndex(slice, "/"); i >= 0 {
+		slice = slice[i+1:]
+	}
+	return slice, unit
 }
@@ -0,0 +1,152 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup1
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/cgroups/v3"
+	"github.com/containerd/cgroups/v3/systemdtest"
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+)
+
+func TestSystemdOpts(t *testing.T) {
+	s, err := NewSystemd("/sys/fs/cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.connect != nil || s.conn != nil {
+		t.Error("the system bus must be used by default")
+	}
+
+	s, err = NewSystemd("/sys/fs/cgroup", WithSystemdUserBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.connect == nil {
+		t.Error("the user bus must be used")
+	}
+
+	conn := &systemdDbus.Conn{}
+	s, err = NewSystemd("/sys/fs/cgroup", WithSystemdConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, release, err := s.dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if got != conn {
+		t.Error("the connection of the caller must be used")
+	}
+
+	if _, err := NewSystemd("/sys/fs/cgroup", WithSystemdConn(nil)); err == nil {
+		t.Error("a nil connection must be rejected")
+	}
+}
+
+func TestSlice(t *testing.T) {
+	for _, tc := range []struct {
+		slice, name, path, parent string
+	}{
+		{"", "foo.scope", "/system.slice/foo.scope", "system.slice"},
+		{"/", "foo.scope", "/foo.scope", ""},
+		{"test-a.slice", "foo.scope", "/test.slice/test-a.slice/foo.scope", "test-a.slice"},
+		{"system.slice", "runc-test", "/system.slice/runc-test.scope", "system.slice"},
+	} {
+		path, err := Slice(tc.slice, tc.name)(Cpu)
+		if err != nil {
+			t.Errorf("Slice(%q, %q): %v", tc.slice, tc.name, err)
+		}
+		if path != tc.path {
+			t.Errorf("Slice(%q, %q) = %q, expected %q", tc.slice, tc.name, path, tc.path)
+		}
+		slice, unit := splitName(path)
+		if slice != tc.parent {
+			t.Errorf("splitName(%q) slice = %q, expected %q", path, slice, tc.parent)
+		}
+		if unit != filepath.Base(tc.path) {
+			t.Errorf("splitName(%q) unit = %q, expected %q", path, unit, filepath.Base(tc.path))
+		}
+	}
+	for _, tc := range []struct {
+		slice, name string
+	}{
+		{"test--a.slice", "foo.scope"},
+		{"test/a.slice", "foo.scope"},
+		{"system.slice", "../foo.scope"},
+		{"system.slice", "foo/bar"},
+		{"system.slice", `foo\x2.scope`},
+	} {
+		_, err := Slice(tc.slice, tc.name)(Cpu)
+		var invalid *cgroups.InvalidUnitNameError
+		if !errors.As(err, &invalid) {
+			t.Errorf("Slice(%q, %q) = %v, expected an InvalidUnitNameError", tc.slice, tc.name, err)
+		}
+	}
+}
+
+func TestSystemdControllerServer(t *testing.T) {
+	server := systemdtest.New(t.TempDir())
+	defer server.Close()
+	conn, err := server.Conn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	s, err := NewSystemd(server.Mountpoint(), WithSystemdConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := Slice("", "server.scope")(SystemdDbus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Create(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	unit, ok := server.Unit("server.scope")
+	if !ok {
+		t.Fatal("the unit must be started")
+	}
+	if unit.Cgroup != path {
+		t.Errorf("unexpected cgroup %q, expected %q", unit.Cgroup, path)
+	}
+	for _, p := range unit.Properties {
+		if p.Name == "Wants" {
+			if wants := p.Value.Value().([]string); len(wants) != 1 || wants[0] != "system.slice" {
+				t.Errorf("unexpected Wants %v", wants)
+			}
+		}
+	}
+
+	if err := s.Delete(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := server.Unit("server.scope"); ok {
+		t.Error("the unit must be stopped")
+	}
+	calls := server.Calls()
+	if last := calls[len(calls)-1]; last.Method != "StopUnit" || last.Unit != "server.scope" {
+		t.Errorf("unexpected call %+v", last)
+	}
+}
@@ -19,7 +19,6 @@ package cgroup1
 import (
 	"bufio"
 	"bytes"
-	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -67,17 +66,26 @@ func defaults(root string) ([]Subsystem, error) {
 // remove will remove a cgroup path handling EAGAIN and EBUSY errors and
 // retrying the remove after a exp timeout
 func remove(path string) error {
+	var err error
 	delay := 10 * time.Millisecond
 	for i := 0; i < 5; i++ {
 		if i != 0 {
 			time.Sleep(delay)
 			delay *= 2
 		}
-		if err := os.RemoveAll(path); err == nil {
+		if err = os.RemoveAll(path); err == nil {
 			return nil
 		}
 	}
-	return fmt.Errorf("cgroups: unable to remove path %q", path)
+	return cgroups.NewError("remove", path, "", "", err)
+}
+
+// writeFile writes data to the named file of the cgroup at path.
+func writeFile(path, name string, data []byte) error {
+	if err := os.WriteFile(filepath.Join(path, name), data, defaultFilePerm); err != nil {
+		return cgroups.NewError("write", path, name, string(data), err)
+	}
+	return nil
 }
 
 // readPids will read all the pids of processes or tasks in a cgroup by the provided path
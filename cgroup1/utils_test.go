@@ -17,9 +17,12 @@
 package cgroup1
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/containerd/cgroups/v3"
 )
 
 func BenchmarkReaduint64(b *testing.B) {
@@ -49,3 +52,21 @@ func TestReadUint(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestWriteFileError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deleted")
+	err := writeFile(path, "pids.max", []byte("10"))
+	var cgErr *Error
+	if !errors.As(err, &cgErr) {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	if cgErr.Op != "write" || cgErr.Path != path || cgErr.File != "pids.max" || cgErr.Value != "10" {
+		t.Errorf("unexpected error %+v", cgErr)
+	}
+	if !cgroups.IsDeleted(err) || cgroups.IsBusy(err) || cgroups.IsNotSupported(err) {
+		t.Errorf("%v must only be reported as deleted", err)
+	}
+	if IgnoreNotExist(err) != nil {
+		t.Errorf("IgnoreNotExist must ignore %v", err)
+	}
+}
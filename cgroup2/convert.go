@@ -0,0 +1,688 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ToResources converts the oci LinuxResources struct into a
+// v2 Resources type for use with this package.
+//
+// Settings that have no cgroup v2 equivalent are dropped, use ConvertResources
+// to have them reported instead.
+//
+// The BlockIO weight is written to io.bfq.weight as is, which accepts the
+// 10-1000 range of blkio.weight; it used to be scaled to the 1-10000 range of
+// io.weight. The Devices rules are converted too, and enforced with an eBPF
+// program.
+//
+// converting cgroups configuration from v1 to v2
+// ref: https://github.com/containers/crun/blob/master/crun.1.md#cgroup-v2
+func ToResources(spec *specs.LinuxResources) *Resources {
+	resources, _ := convertResources(spec, false)
+	return resources
+}
+
+// ConvertResources converts the oci LinuxResources struct into a v2 Resources
+// type for use with this package, following the rules of the runtime spec for
+// cgroup v2 hosts. An error is returned for settings that can't be honored on
+// cgroup v2, like a swappiness, disabling the OOM killer, leaf weights or the
+// network settings, and for invalid combinations, like a swap limit without a
+// memory limit.
+//
+// The keys of Unified are written to the cgroup as is, after all the other
+// settings.
+func ConvertResources(spec *specs.LinuxResources) (*Resources, error) {
+	return convertResources(spec, true)
+}
+
+func convertResources(spec *specs.LinuxResources, strict bool) (*Resources, error) {
+	var (
+		resources Resources
+		errs      []error
+	)
+	// unsupported records that a setting can't be converted. It is only an
+	// error when strict is set.
+	unsupported := func(format string, args ...interface{}) {
+		if strict {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	if spec == nil {
+		return &resources, nil
+	}
+	if cpu := spec.CPU; cpu != nil {
+		resources.CPU = &CPU{
+			Cpus:  cpu.Cpus,
+			Mems:  cpu.Mems,
+			Burst: cpu.Burst,
+		}
+		if shares := cpu.Shares; shares != nil && *shares != 0 {
+			weight := convertCPUShares(*shares)
+			resources.CPU.Weight = &weight
+		}
+		if cpu.Quota != nil || cpu.Period != nil {
+			var quota *int64
+			if cpu.Quota != nil && *cpu.Quota > 0 {
+				quota = cpu.Quota
+			}
+			period := defaultCPUPeriod
+			if cpu.Period != nil && *cpu.Period != 0 {
+				period = *cpu.Period
+			}
+			resources.CPU.Max = NewCPUMax(quota, &period)
+		}
+		if idle := cpu.Idle; idle != nil {
+			switch *idle {
+			case 0, 1:
+				v := uint64(*idle)
+				resources.CPU.Idle = &v
+			default:
+				unsupported("cgroups: invalid cpu idle value %d, must be 0 or 1", *idle)
+			}
+		}
+		if (cpu.RealtimeRuntime != nil && *cpu.RealtimeRuntime != 0) || (cpu.RealtimePeriod != nil && *cpu.RealtimePeriod != 0) {
+			unsupported("cgroups: realtime scheduling is not supported on cgroup v2")
+		}
+	}
+	if mem := spec.Memory; mem != nil {
+		resources.Memory = &Memory{}
+		var limit, swap int64
+		if l := mem.Limit; l != nil {
+			limit = *l
+			resources.Memory.Max = l
+		}
+		if s := mem.Swap; s != nil {
+			swap = *s
+		}
+		v, err := convertMemorySwap(swap, limit)
+		switch {
+		case err != nil:
+			unsupported("%w", err)
+		case v != 0 || swap != 0:
+			// an explicit swap of 0 leaves memory.swap.max unset, while a
+			// swap equal to the limit disables swap
+			resources.Memory.Swap = &v
+		}
+		if l := mem.Reservation; l != nil {
+			resources.Memory.Low = l
+		}
+		// docker uses -1 to leave the swappiness unset
+		if s := mem.Swappiness; s != nil && *s != math.MaxUint64 {
+			unsupported("cgroups: memory swappiness is not supported on cgroup v2")
+		}
+		if d := mem.DisableOOMKiller; d != nil && *d {
+			unsupported("cgroups: disabling the OOM killer is not supported on cgroup v2")
+		}
+		if c := mem.CheckBeforeUpdate; c != nil {
+			resources.Memory.CheckBeforeUpdate = *c
+		}
+		// the kernel memory limits are deprecated by the runtime spec, and
+		// accounted to memory.max on cgroup v2
+	}
+	if hugetlbs := spec.HugepageLimits; hugetlbs != nil {
+		hugeTlbUsage := HugeTlb{}
+		for _, hugetlb := range hugetlbs {
+			hugeTlbUsage = append(hugeTlbUsage, HugeTlbEntry{
+				HugePageSize: hugetlb.Pagesize,
+				Limit:        hugetlb.Limit,
+			})
+		}
+		resources.HugeTlb = &hugeTlbUsage
+	}
+	if pids := spec.Pids; pids != nil {
+		resources.Pids = &Pids{
+			Max: pids.Limit,
+		}
+	}
+	if i := spec.BlockIO; i != nil {
+		resources.IO = &IO{}
+		// io.bfq.weight uses the same range as blkio.weight in cgroup v1
+		if i.Weight != nil {
+			resources.IO.BFQ.Weight = *i.Weight
+		}
+		if i.LeafWeight != nil {
+			unsupported("cgroups: blkio leaf weight is not supported on cgroup v2")
+		}
+		for _, d := range i.WeightDevice {
+			if d.LeafWeight != nil {
+				unsupported("cgroups: blkio leaf weight of device %d:%d is not supported on cgroup v2", d.Major, d.Minor)
+			}
+			if d.Weight != nil {
+				resources.IO.BFQ.WeightDevice = append(resources.IO.BFQ.WeightDevice, BFQDeviceWeight{
+					Major:  d.Major,
+					Minor:  d.Minor,
+					Weight: *d.Weight,
+				})
+			}
+		}
+		for _, t := range []struct {
+			Type    IOType
+			Devices []specs.LinuxThrottleDevice
+		}{
+			{ReadBPS, i.ThrottleReadBpsDevice},
+			{WriteBPS, i.ThrottleWriteBpsDevice},
+			{ReadIOPS, i.ThrottleReadIOPSDevice},
+			{WriteIOPS, i.ThrottleWriteIOPSDevice},
+		} {
+			for _, d := range t.Devices {
+				resources.IO.Max = append(resources.IO.Max, Entry{
+					Type:  t.Type,
+					Major: d.Major,
+					Minor: d.Minor,
+					Rate:  d.Rate,
+				})
+			}
+		}
+	}
+	if i := spec.Rdma; i != nil {
+		resources.RDMA = &RDMA{}
+		for device, value := range spec.Rdma {
+			if device != "" && (value.HcaHandles != nil && value.HcaObjects != nil) {
+				resources.RDMA.Limit = append(resources.RDMA.Limit, RDMAEntry{
+					Device:     device,
+					HcaHandles: *value.HcaHandles,
+					HcaObjects: *value.HcaObjects,
+				})
+			}
+		}
+	}
+	if n := spec.Network; n != nil && (n.ClassID != nil || len(n.Priorities) > 0) {
+		unsupported("cgroups: network class id and priorities are not supported on cgroup v2")
+	}
+	if len(spec.Devices) > 0 {
+		resources.Devices = spec.Devices
+	}
+	for key, value := range spec.Unified {
+		if err := validateUnifiedKey(key); err != nil {
+			unsupported("%w", err)
+			continue
+		}
+		if resources.Unified == nil {
+			resources.Unified = make(map[string]string, len(spec.Unified))
+		}
+		resources.Unified[key] = value
+	}
+	switch len(errs) {
+	case 0:
+		return &resources, nil
+	case 1:
+		return nil, errs[0]
+	default:
+		return nil, conversionErrors(errs)
+	}
+}
+
+// conversionErrors reports all the settings that couldn't be converted at once
+type conversionErrors []error
+
+func (e conversionErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the errors matches target. errors.Is only follows
+// Unwrap() []error since Go 1.20.
+func (e conversionErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target, like Is.
+func (e conversionErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap returns the errors, for the Go 1.20+ error inspection helpers.
+func (e conversionErrors) Unwrap() []error {
+	return e
+}
+
+// convertCPUShares converts the cpu shares of cgroup v1, from [2-262144], to
+// the cpu weight of cgroup v2, from [1-10000].
+func convertCPUShares(shares uint64) uint64 {
+	return 1 + ((shares-2)*9999)/262142
+}
+
+// convertCPUWeight converts the cpu weight of cgroup v2 back to cpu shares. The
+// result is rounded up, so that converting it again gives the same weight.
+func convertCPUWeight(weight uint64) uint64 {
+	return 2 + ((weight-1)*262142+9998)/9999
+}
+
+// convertMemorySwap converts the memory+swap limit of cgroup v1 into the swap
+// limit of cgroup v2, following runc:
+//   - a swap of -1 is unlimited, a swap of 0 is unset
+//   - when the memory is unlimited and the swap unset, the swap is unlimited too
+//   - otherwise the swap limit is the memory+swap limit minus the memory limit
+func convertMemorySwap(swap, memory int64) (int64, error) {
+	if memory == -1 && swap == 0 {
+		return -1, nil
+	}
+	if swap == -1 || swap == 0 {
+		return swap, nil
+	}
+	if memory == 0 || memory == -1 {
+		return 0, errors.New("cgroups: unable to set a swap limit without a memory limit")
+	}
+	if memory < 0 {
+		return 0, fmt.Errorf("cgroups: invalid memory limit %d", memory)
+	}
+	if swap < memory {
+		return 0, fmt.Errorf("cgroups: memory+swap limit %d must be greater than or equal to the memory limit %d", swap, memory)
+	}
+	return swap - memory, nil
+}
+
+func validateUnifiedKey(key string) error {
+	if key == "" || key == "." || key == ".." || strings.Contains(key, "/") {
+		return fmt.Errorf("cgroups: invalid unified resource key %q", key)
+	}
+	return nil
+}
+
+// FromResources converts the v2 Resources type back into the oci LinuxResources
+// struct, inverting the conversions of ToResources. Resources that have no
+// equivalent in the runtime spec, like memory.min, memory.high, or a swap limit
+// without a memory limit, are reported in Unified.
+func FromResources(r *Resources) *specs.LinuxResources {
+	spec := &specs.LinuxResources{}
+	if r == nil {
+		return spec
+	}
+	unified := make(map[string]string)
+	if cpu := r.CPU; cpu != nil {
+		spec.CPU = &specs.LinuxCPU{
+			Cpus:  cpu.Cpus,
+			Mems:  cpu.Mems,
+			Burst: cpu.Burst,
+		}
+		if cpu.Weight != nil && *cpu.Weight != 0 {
+			shares := convertCPUWeight(*cpu.Weight)
+			spec.CPU.Shares = &shares
+		}
+		if quota, period, err := cpu.Max.parse(); err == nil {
+			spec.CPU.Quota, spec.CPU.Period = &quota, &period
+		}
+		if cpu.Idle != nil {
+			idle := int64(*cpu.Idle)
+			spec.CPU.Idle = &idle
+		}
+	}
+	if mem := r.Memory; mem != nil {
+		spec.Memory = &specs.LinuxMemory{
+			Limit:       mem.Max,
+			Reservation: mem.Low,
+		}
+		if swap := mem.Swap; swap != nil {
+			switch {
+			case *swap == -1:
+				spec.Memory.Swap = swap
+			case mem.Max != nil && *mem.Max != -1:
+				// the runtime spec uses the memory+swap limit
+				v := *mem.Max + *swap
+				spec.Memory.Swap = &v
+			default:
+				unified["memory.swap.max"] = strconv.FormatInt(*swap, 10)
+			}
+		}
+		if mem.CheckBeforeUpdate {
+			v := true
+			spec.Memory.CheckBeforeUpdate = &v
+		}
+		// the kernel defaults are left out
+		if mem.Min != nil && *mem.Min != 0 {
+			unified["memory.min"] = fmt.Sprint(memoryValue(*mem.Min))
+		}
+		if mem.High != nil && *mem.High != -1 {
+			unified["memory.high"] = fmt.Sprint(memoryValue(*mem.High))
+		}
+	}
+	if r.Pids != nil {
+		spec.Pids = &specs.LinuxPids{
+			Limit: r.Pids.Max,
+		}
+	}
+	if io := r.IO; io != nil {
+		spec.BlockIO = &specs.LinuxBlockIO{}
+		if io.BFQ.Weight != 0 {
+			weight := io.BFQ.Weight
+			spec.BlockIO.Weight = &weight
+		}
+		for _, d := range io.BFQ.WeightDevice {
+			weight := d.Weight
+			device := specs.LinuxWeightDevice{Weight: &weight}
+			device.Major, device.Minor = d.Major, d.Minor
+			spec.BlockIO.WeightDevice = append(spec.BlockIO.WeightDevice, device)
+		}
+		for _, e := range io.Max {
+			device := specs.LinuxThrottleDevice{Rate: e.Rate}
+			device.Major, device.Minor = e.Major, e.Minor
+			switch e.Type {
+			case ReadBPS:
+				spec.BlockIO.ThrottleReadBpsDevice = append(spec.BlockIO.ThrottleReadBpsDevice, device)
+			case WriteBPS:
+				spec.BlockIO.ThrottleWriteBpsDevice = append(spec.BlockIO.ThrottleWriteBpsDevice, device)
+			case ReadIOPS:
+				spec.BlockIO.ThrottleReadIOPSDevice = append(spec.BlockIO.ThrottleReadIOPSDevice, device)
+			case WriteIOPS:
+				spec.BlockIO.ThrottleWriteIOPSDevice = append(spec.BlockIO.ThrottleWriteIOPSDevice, device)
+			}
+		}
+	}
+	if r.RDMA != nil {
+		spec.Rdma = make(map[string]specs.LinuxRdma, len(r.RDMA.Limit))
+		for _, e := range r.RDMA.Limit {
+			handles, objects := e.HcaHandles, e.HcaObjects
+			spec.Rdma[e.Device] = specs.LinuxRdma{
+				HcaHandles: &handles,
+				HcaObjects: &objects,
+			}
+		}
+	}
+	if r.HugeTlb != nil {
+		for _, e := range *r.HugeTlb {
+			spec.HugepageLimits = append(spec.HugepageLimits, specs.LinuxHugepageLimit{
+				Pagesize: e.HugePageSize,
+				Limit:    e.Limit,
+			})
+		}
+	}
+	if len(r.Devices) > 0 {
+		spec.Devices = r.Devices
+	}
+	// explicit unified resources take precedence
+	for k, v := range r.Unified {
+		unified[k] = v
+	}
+	if len(unified) > 0 {
+		spec.Unified = unified
+	}
+	return spec
+}
+
+// Resources reads the resources currently applied to the cgroup. Only the
+// resources of the controllers enabled for the cgroup are returned.
+//
+// The device rules can't be read back from the kernel, so Devices is always
+// empty.
+func (c *Manager) Resources() (*Resources, error) {
+	var (
+		r   Resources
+		err error
+	)
+	if r.CPU, err = c.cpuResources(); err != nil {
+		return nil, err
+	}
+	if r.Memory, err = c.memoryResources(); err != nil {
+		return nil, err
+	}
+	max, err := c.readResource("pids.max")
+	if err != nil {
+		return nil, err
+	}
+	if max != "" {
+		limit, err := parseResourceInt64(max)
+		if err != nil {
+			return nil, err
+		}
+		r.Pids = &Pids{Max: limit}
+	}
+	if r.IO, err = c.ioResources(); err != nil {
+		return nil, err
+	}
+	rdma, err := c.readResource("rdma.max")
+	if err != nil {
+		return nil, err
+	}
+	if rdma != "" {
+		r.RDMA = &RDMA{}
+		for _, e := range toRdmaEntry(strings.Split(rdma, "\n")) {
+			r.RDMA.Limit = append(r.RDMA.Limit, RDMAEntry{
+				Device:     e.Device,
+				HcaHandles: e.HcaHandles,
+				HcaObjects: e.HcaObjects,
+			})
+		}
+	}
+	for _, pagesize := range hugePageSizes() {
+		max, err := c.readResource("hugetlb." + pagesize + ".max")
+		if err != nil {
+			return nil, err
+		}
+		if max == "" {
+			continue
+		}
+		limit := uint64(math.MaxUint64)
+		if max != "max" {
+			if limit, err = strconv.ParseUint(max, 10, 64); err != nil {
+				return nil, err
+			}
+		}
+		if r.HugeTlb == nil {
+			r.HugeTlb = &HugeTlb{}
+		}
+		*r.HugeTlb = append(*r.HugeTlb, HugeTlbEntry{HugePageSize: pagesize, Limit: limit})
+	}
+	return &r, nil
+}
+
+// LinuxResources reads the resources currently applied to the cgroup, in the
+// form of the runtime spec. See Resources and FromResources.
+func (c *Manager) LinuxResources() (*specs.LinuxResources, error) {
+	r, err := c.Resources()
+	if err != nil {
+		return nil, err
+	}
+	return FromResources(r), nil
+}
+
+// readResource returns the trimmed content of the named file of the cgroup, or
+// an empty string when the file doesn't exist.
+func (c *Manager) readResource(name string) (string, error) {
+	data, err := c.readFile(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// parseResourceInt64 parses a limit, where "max" stands for no limit (-1).
+func parseResourceInt64(v string) (int64, error) {
+	if v == "max" {
+		return -1, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func (c *Manager) cpuResources() (*CPU, error) {
+	var (
+		cpu   CPU
+		found bool
+	)
+	for _, f := range []struct {
+		name  string
+		value **uint64
+	}{
+		{"cpu.weight", &cpu.Weight},
+		{"cpu.idle", &cpu.Idle},
+		{"cpu.max.burst", &cpu.Burst},
+	} {
+		v, err := c.readResource(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		*f.value, found = &n, true
+	}
+	for _, f := range []struct {
+		name  string
+		value *string
+	}{
+		{"cpu.max", (*string)(&cpu.Max)},
+		{"cpuset.cpus", &cpu.Cpus},
+		{"cpuset.mems", &cpu.Mems},
+	} {
+		v, err := c.readResource(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if v != "" {
+			*f.value, found = v, true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return &cpu, nil
+}
+
+func (c *Manager) memoryResources() (*Memory, error) {
+	var (
+		mem   Memory
+		found bool
+	)
+	for _, f := range []struct {
+		name  string
+		value **int64
+	}{
+		{"memory.swap.max", &mem.Swap},
+		{"memory.min", &mem.Min},
+		{"memory.max", &mem.Max},
+		{"memory.low", &mem.Low},
+		{"memory.high", &mem.High},
+	} {
+		v, err := c.readResource(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if v == "" {
+			continue
+		}
+		n, err := parseResourceInt64(v)
+		if err != nil {
+			return nil, err
+		}
+		*f.value, found = &n, true
+	}
+	if !found {
+		return nil, nil
+	}
+	return &mem, nil
+}
+
+func (c *Manager) ioResources() (*IO, error) {
+	weights, err := c.readResource("io.bfq.weight")
+	if err != nil {
+		return nil, err
+	}
+	max, err := c.readResource("io.max")
+	if err != nil {
+		return nil, err
+	}
+	if weights == "" && max == "" {
+		return nil, nil
+	}
+	var io IO
+	for _, line := range strings.Split(weights, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		weight, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		if fields[0] == "default" {
+			io.BFQ.Weight = uint16(weight)
+			continue
+		}
+		major, minor, err := parseDevice(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		io.BFQ.WeightDevice = append(io.BFQ.WeightDevice, BFQDeviceWeight{Major: major, Minor: minor, Weight: uint16(weight)})
+	}
+	for _, line := range strings.Split(max, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		major, minor, err := parseDevice(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range fields[1:] {
+			key, value, ok := strings.Cut(kv, "=")
+			if !ok || value == "max" {
+				continue
+			}
+			rate, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			io.Max = append(io.Max, Entry{Type: IOType(key), Major: major, Minor: minor, Rate: rate})
+		}
+	}
+	return &io, nil
+}
+
+// parseDevice parses a "major:minor" device number.
+func parseDevice(v string) (int64, int64, error) {
+	major, minor, ok := strings.Cut(v, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid device %q", v)
+	}
+	ma, err := strconv.ParseInt(major, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	mi, err := strconv.ParseInt(minor, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ma, mi, nil
+}
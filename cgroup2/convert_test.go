@@ -0,0 +1,262 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func int64Ptr(v int64) *int64 { return &v }
+
+func uint64Ptr(v uint64) *uint64 { return &v }
+
+func uint16Ptr(v uint16) *uint16 { return &v }
+
+func boolPtr(v bool) *bool { return &v }
+
+func TestConvertMemorySwap(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		swap, memory  int64
+		expected      int64
+		expectedError bool
+	}{
+		{name: "unset", swap: 0, memory: 0, expected: 0},
+		{name: "unlimited memory", swap: 0, memory: -1, expected: -1},
+		{name: "unlimited swap", swap: -1, memory: 1000, expected: -1},
+		{name: "only memory", swap: 0, memory: 1000, expected: 0},
+		{name: "memory and swap", swap: 3000, memory: 1000, expected: 2000},
+		{name: "no swap", swap: 1000, memory: 1000, expected: 0},
+		{name: "swap without memory", swap: 1000, memory: 0, expectedError: true},
+		{name: "swap with unlimited memory", swap: 1000, memory: -1, expectedError: true},
+		{name: "swap below memory", swap: 500, memory: 1000, expectedError: true},
+		{name: "invalid memory", swap: 500, memory: -2, expectedError: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := convertMemorySwap(tc.swap, tc.memory)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, v)
+		})
+	}
+}
+
+func TestConvertResources(t *testing.T) {
+	devices := []specs.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}}
+	res, err := ConvertResources(&specs.LinuxResources{
+		Devices: devices,
+		CPU: &specs.LinuxCPU{
+			Quota: int64Ptr(-1),
+			Burst: uint64Ptr(1000),
+			Idle:  int64Ptr(1),
+		},
+		Memory: &specs.LinuxMemory{
+			Limit:             int64Ptr(-1),
+			Swappiness:        uint64Ptr(^uint64(0)),
+			DisableOOMKiller:  boolPtr(false),
+			CheckBeforeUpdate: boolPtr(true),
+		},
+		BlockIO: &specs.LinuxBlockIO{
+			Weight: uint16Ptr(500),
+			WeightDevice: []specs.LinuxWeightDevice{
+				{LinuxBlockIODevice: specs.LinuxBlockIODevice{Major: 8, Minor: 0}, Weight: uint16Ptr(100)},
+			},
+		},
+		Unified: map[string]string{
+			"memory.oom.group": "1",
+			"cgroup.freeze":    "0",
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, devices, res.Devices)
+	assert.Equal(t, CPUMax("max 100000"), res.CPU.Max)
+	assert.Equal(t, uint64(1000), *res.CPU.Burst)
+	assert.Equal(t, uint64(1), *res.CPU.Idle)
+	assert.Equal(t, int64(-1), *res.Memory.Swap)
+	assert.True(t, res.Memory.CheckBeforeUpdate)
+	assert.Equal(t, uint16(500), res.IO.BFQ.Weight)
+	assert.Equal(t, []BFQDeviceWeight{{Major: 8, Minor: 0, Weight: 100}}, res.IO.BFQ.WeightDevice)
+	assert.ElementsMatch(t, []string{"cpu", "memory", "io"}, res.EnabledControllers())
+
+	values := res.Values()
+	assert.Contains(t, values, Value{filename: "memory.max", value: "max"})
+	assert.Contains(t, values, Value{filename: "memory.swap.max", value: "max"})
+	assert.Contains(t, values, Value{filename: "io.bfq.weight", value: "8:0 100"})
+	// unified resources come last
+	assert.Equal(t, []Value{
+		{filename: "cgroup.freeze", value: "0"},
+		{filename: "memory.oom.group", value: "1"},
+	}, values[len(values)-2:])
+}
+
+func TestConvertResourcesUnsupported(t *testing.T) {
+	for name, spec := range map[string]*specs.LinuxResources{
+		"swappiness":         {Memory: &specs.LinuxMemory{Swappiness: uint64Ptr(60)}},
+		"disable oom killer": {Memory: &specs.LinuxMemory{DisableOOMKiller: boolPtr(true)}},
+		"swap only":          {Memory: &specs.LinuxMemory{Swap: int64Ptr(1000)}},
+		"leaf weight":        {BlockIO: &specs.LinuxBlockIO{LeafWeight: uint16Ptr(100)}},
+		"device leaf weight": {BlockIO: &specs.LinuxBlockIO{WeightDevice: []specs.LinuxWeightDevice{{LeafWeight: uint16Ptr(100)}}}},
+		"cpu idle":           {CPU: &specs.LinuxCPU{Idle: int64Ptr(2)}},
+		"realtime":           {CPU: &specs.LinuxCPU{RealtimeRuntime: int64Ptr(1000)}},
+		"network":            {Network: &specs.LinuxNetwork{Priorities: []specs.LinuxInterfacePriority{{Name: "eth0", Priority: 1}}}},
+		"unified":            {Unified: map[string]string{"../memory.max": "1"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ConvertResources(spec)
+			assert.Error(t, err)
+			// ToResources drops what can't be converted
+			assert.NotNil(t, ToResources(spec))
+		})
+	}
+
+	_, err := ConvertResources(&specs.LinuxResources{
+		Memory: &specs.LinuxMemory{Swappiness: uint64Ptr(60), DisableOOMKiller: boolPtr(true)},
+	})
+	assert.ErrorContains(t, err, "swappiness")
+	assert.ErrorContains(t, err, "OOM killer")
+
+	err = conversionErrors{fmt.Errorf("cgroups: %w", os.ErrNotExist), &ValidationError{Field: "memory.max"}}
+	assert.True(t, err.(conversionErrors).Is(os.ErrNotExist))
+	assert.False(t, err.(conversionErrors).Is(os.ErrPermission))
+	var invalid *ValidationError
+	require.True(t, err.(conversionErrors).As(&invalid))
+	assert.Equal(t, "memory.max", invalid.Field)
+
+	res := ToResources(&specs.LinuxResources{Memory: &specs.LinuxMemory{Swap: int64Ptr(1000)}})
+	assert.Nil(t, res.Memory.Swap)
+}
+
+func TestCheckMemoryUsage(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "memory.current"), []byte("4096\n"), 0o644))
+	c := &Manager{unifiedMountpoint: root, path: root, filePerm: testFilePerm}
+
+	err := c.Update(&Resources{Memory: &Memory{Max: int64Ptr(1024), CheckBeforeUpdate: true}})
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(root, "memory.max"))
+	assert.True(t, os.IsNotExist(err), "the limit must not be written")
+
+	require.NoError(t, c.Update(&Resources{Memory: &Memory{Max: int64Ptr(8192), CheckBeforeUpdate: true}}))
+	checkFileContent(t, root, "memory.max", "8192")
+	require.NoError(t, c.Update(&Resources{Memory: &Memory{Max: int64Ptr(1024)}}))
+	checkFileContent(t, root, "memory.max", "1024")
+}
+
+func TestConvertCPUWeight(t *testing.T) {
+	for weight := uint64(1); weight <= 10000; weight++ {
+		shares := convertCPUWeight(weight)
+		require.GreaterOrEqual(t, shares, uint64(2))
+		require.LessOrEqual(t, shares, uint64(262144))
+		require.Equal(t, weight, convertCPUShares(shares), "shares %d", shares)
+	}
+}
+
+func TestFromResources(t *testing.T) {
+	device := func(major, minor int64) specs.LinuxBlockIODevice {
+		return specs.LinuxBlockIODevice{Major: major, Minor: minor}
+	}
+	spec := &specs.LinuxResources{
+		CPU: &specs.LinuxCPU{
+			Shares: uint64Ptr(1024),
+			Quota:  int64Ptr(50000),
+			Period: uint64Ptr(100000),
+			Cpus:   "0-1",
+			Idle:   int64Ptr(0),
+		},
+		Memory: &specs.LinuxMemory{
+			Limit:       int64Ptr(1 << 30),
+			Swap:        int64Ptr(2 << 30),
+			Reservation: int64Ptr(1 << 20),
+		},
+		Pids: &specs.LinuxPids{Limit: 100},
+		BlockIO: &specs.LinuxBlockIO{
+			Weight:                  uint16Ptr(300),
+			WeightDevice:            []specs.LinuxWeightDevice{{LinuxBlockIODevice: device(8, 0), Weight: uint16Ptr(100)}},
+			ThrottleReadBpsDevice:   []specs.LinuxThrottleDevice{{LinuxBlockIODevice: device(8, 0), Rate: 1000}},
+			ThrottleWriteIOPSDevice: []specs.LinuxThrottleDevice{{LinuxBlockIODevice: device(8, 16), Rate: 10}},
+		},
+		HugepageLimits: []specs.LinuxHugepageLimit{{Pagesize: "2MB", Limit: 1 << 21}},
+		Unified:        map[string]string{"memory.oom.group": "1"},
+	}
+	res, err := ConvertResources(spec)
+	require.NoError(t, err)
+	out := FromResources(res)
+	// shares are rounded to the closest value of the cgroup v2 range
+	assert.Equal(t, *res.CPU.Weight, convertCPUShares(*out.CPU.Shares))
+	out.CPU.Shares = spec.CPU.Shares
+	assert.Equal(t, spec, out)
+
+	out = FromResources(&Resources{Memory: &Memory{Swap: int64Ptr(1024), High: int64Ptr(4096)}})
+	assert.Nil(t, out.Memory.Swap)
+	assert.Equal(t, map[string]string{"memory.swap.max": "1024", "memory.high": "4096"}, out.Unified)
+}
+
+func TestManagerResources(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"cpu.weight":      "100\n",
+		"cpu.max":         "max 100000\n",
+		"cpuset.cpus":     "\n",
+		"memory.max":      "max\n",
+		"memory.swap.max": "0\n",
+		"memory.high":     "max\n",
+		"pids.max":        "max\n",
+		"io.bfq.weight":   "default 100\n8:0 200\n",
+		"io.max":          "8:0 rbps=1000 wbps=max riops=max wiops=10\n",
+		"rdma.max":        "mlx4_0 hca_handle=2 hca_object=max\n",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(content), 0o644))
+	}
+	c := &Manager{unifiedMountpoint: root, path: root}
+	r, err := c.Resources()
+	require.NoError(t, err)
+
+	assert.Equal(t, uint64(100), *r.CPU.Weight)
+	assert.Equal(t, CPUMax("max 100000"), r.CPU.Max)
+	assert.Empty(t, r.CPU.Cpus)
+	assert.Equal(t, int64(-1), *r.Memory.Max)
+	assert.Equal(t, int64(0), *r.Memory.Swap)
+	assert.Nil(t, r.Memory.Low)
+	assert.Equal(t, int64(-1), r.Pids.Max)
+	assert.Equal(t, BFQ{Weight: 100, WeightDevice: []BFQDeviceWeight{{Major: 8, Minor: 0, Weight: 200}}}, r.IO.BFQ)
+	assert.Equal(t, []Entry{
+		{Type: ReadBPS, Major: 8, Minor: 0, Rate: 1000},
+		{Type: WriteIOPS, Major: 8, Minor: 0, Rate: 10},
+	}, r.IO.Max)
+	assert.Equal(t, []RDMAEntry{{Device: "mlx4_0", HcaHandles: 2, HcaObjects: math.MaxUint32}}, r.RDMA.Limit)
+
+	spec, err := c.LinuxResources()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), convertCPUShares(*spec.CPU.Shares))
+	assert.Equal(t, int64(-1), *spec.CPU.Quota)
+	assert.Equal(t, int64(-1), *spec.Memory.Limit)
+	assert.Nil(t, spec.Memory.Swap, "a swap limit without memory limit can't be expressed")
+	assert.Equal(t, "0", spec.Unified["memory.swap.max"])
+	assert.Equal(t, uint16(100), *spec.BlockIO.Weight)
+}
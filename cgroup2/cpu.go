@@ -17,19 +17,138 @@
 package cgroup2
 
 import (
+	"fmt"
 	"math"
 	"strconv"
 	"strings"
 )
 
+// defaultCPUPeriod is the period used by the kernel when cpu.max is written
+// without one
+const defaultCPUPeriod uint64 = 100000
+
+// CPUMax is the content of the cpu.max file: "$MAX $PERIOD", where $MAX is
+// either a quota in microseconds or "max" for no limit.
 type CPUMax string
 
+// NewCPUMax returns the CPUMax for quota and period. A nil quota means no limit,
+// and a nil period means the default period of 100ms.
 func NewCPUMax(quota *int64, period *uint64) CPUMax {
 	max := "max"
 	if quota != nil {
 		max = strconv.FormatInt(*quota, 10)
 	}
-	return CPUMax(strings.Join([]string{max, strconv.FormatUint(*period, 10)}, " "))
+	p := defaultCPUPeriod
+	if period != nil {
+		p = *period
+	}
+	return CPUMax(strings.Join([]string{max, strconv.FormatUint(p, 10)}, " "))
+}
+
+// NewCPUMaxFromCPUs returns the CPUMax limiting a cgroup to a number of CPUs,
+// e.g. 1.5. The quota is rounded up to the next microsecond. A number of CPUs
+// that is not positive means no limit, and a zero period means the default one.
+func NewCPUMaxFromCPUs(cpus float64, period uint64) CPUMax {
+	if period == 0 {
+		period = defaultCPUPeriod
+	}
+	if cpus <= 0 {
+		return NewCPUMax(nil, &period)
+	}
+	quota := int64(math.Ceil(cpus * float64(period)))
+	return NewCPUMax(&quota, &period)
+}
+
+// ParseCPUMax parses the content of a cpu.max file. The period is optional, as
+// when writing the file, and defaults to 100ms.
+func ParseCPUMax(s string) (CPUMax, error) {
+	quota, period, err := CPUMax(s).parse()
+	if err != nil {
+		return "", fmt.Errorf("cgroups: %w", err)
+	}
+	if quota == -1 {
+		return NewCPUMax(nil, &period), nil
+	}
+	return NewCPUMax(&quota, &period), nil
+}
+
+// parse returns the quota, -1 for no limit, and the period of c.
+func (c CPUMax) parse() (int64, uint64, error) {
+	values := strings.Fields(string(c))
+	if len(values) != 1 && len(values) != 2 {
+		return 0, 0, fmt.Errorf("invalid cpu.max %q: must be \"$MAX $PERIOD\"", string(c))
+	}
+	quota := int64(-1)
+	if values[0] != "max" {
+		var err error
+		quota, err = strconv.ParseInt(values[0], 10, 64)
+		if err != nil || quota <= 0 {
+			return 0, 0, fmt.Errorf("invalid cpu.max quota %q", values[0])
+		}
+	}
+	period := defaultCPUPeriod
+	if len(values) == 2 {
+		var err error
+		period, err = strconv.ParseUint(values[1], 10, 64)
+		if err != nil || period == 0 {
+			return 0, 0, fmt.Errorf("invalid cpu.max period %q", values[1])
+		}
+	}
+	return quota, period, nil
+}
+
+// Quota returns the quota in microseconds, or -1 when c is unlimited or
+// malformed. Use ParseCPUMax to validate a value.
+func (c CPUMax) Quota() int64 {
+	quota, _, err := c.parse()
+	if err != nil {
+		return -1
+	}
+	return quota
+}
+
+// Period returns the period in microseconds, or the default period when c has
+// none or is malformed.
+func (c CPUMax) Period() uint64 {
+	_, period, err := c.parse()
+	if err != nil {
+		return defaultCPUPeriod
+	}
+	return period
+}
+
+// IsUnlimited returns whether c sets no quota.
+func (c CPUMax) IsUnlimited() bool {
+	return c.Quota() == -1
+}
+
+// CPUs returns the number of CPUs c limits a cgroup to, e.g. 1.5, or -1 when it
+// is unlimited.
+func (c CPUMax) CPUs() float64 {
+	quota, period, err := c.parse()
+	if err != nil || quota == -1 {
+		return -1
+	}
+	return float64(quota) / float64(period)
+}
+
+// CPUQuotaPerSecUSec returns the value of the CPUQuotaPerSecUSec systemd
+// property matching c, or math.MaxUint64 (USEC_INFINITY) when it is unlimited.
+//
+// systemd converts CPUQuotaPerSecUSec (microseconds per CPU second) to CPUQuota
+// (integer percentage of CPU) internally. This means that if a fractional
+// percent of CPU is indicated, it is rounded up to the nearest 10ms (1% of a
+// second) such that child cgroups can set the quota they expect.
+func (c CPUMax) CPUQuotaPerSecUSec() uint64 {
+	quota, period, err := c.parse()
+	if err != nil || quota == -1 {
+		return math.MaxUint64
+	}
+	usec := uint64(quota) * 1000000 / period
+	if usec%10000 != 0 {
+		usec = ((usec / 10000) + 1) * 10000
+	}
+	return usec
 }
 
 type CPU struct {
@@ -41,21 +160,6 @@ type CPU struct {
 	Mems   string
 }
 
-func (c CPUMax) extractQuotaAndPeriod() (int64, uint64) {
-	var (
-		quota  int64
-		period uint64
-	)
-	values := strings.Split(string(c), " ")
-	if values[0] == "max" {
-		quota = math.MaxInt64
-	} else {
-		quota, _ = strconv.ParseInt(values[0], 10, 64)
-	}
-	period, _ = strconv.ParseUint(values[1], 10, 64)
-	return quota, period
-}
-
 func (r *CPU) Values() (o []Value) {
 	if r.Weight != nil {
 		o = append(o, Value{
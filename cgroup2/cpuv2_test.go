@@ -111,23 +111,55 @@ func TestSystemdCgroupCpuController_NilWeight(t *testing.T) {
 	require.NoError(t, err, "failed to init new cgroup systemd manager")
 }
 
-func TestExtractQuotaAndPeriod(t *testing.T) {
-	var (
-		period uint64
-		quota  int64
-	)
-	quota = 10000
-	period = 8000
-	cpuMax := NewCPUMax(&quota, &period)
-	tquota, tPeriod := cpuMax.extractQuotaAndPeriod()
+func TestNewCPUMaxNilPeriod(t *testing.T) {
+	var quota int64 = 50000
+	assert.Equal(t, CPUMax("50000 100000"), NewCPUMax(&quota, nil))
+	assert.Equal(t, CPUMax("max 100000"), NewCPUMax(nil, nil))
+}
+
+func TestParseCPUMax(t *testing.T) {
+	for s, expected := range map[string]CPUMax{
+		"max":           "max 100000",
+		"max 10000":     "max 10000",
+		"50000":         "50000 100000",
+		" 8000 10000\n": "8000 10000",
+	} {
+		max, err := ParseCPUMax(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expected, max)
+	}
+	for _, s := range []string{"", "0 100000", "-1 100000", "1000 0", "abc", "1000 100000 1"} {
+		_, err := ParseCPUMax(s)
+		assert.Error(t, err, s)
+	}
 
-	assert.Equal(t, quota, tquota)
-	assert.Equal(t, period, tPeriod)
+	max := CPUMax("150000 100000")
+	assert.Equal(t, int64(150000), max.Quota())
+	assert.Equal(t, uint64(100000), max.Period())
+	assert.False(t, max.IsUnlimited())
+	assert.Equal(t, 1.5, max.CPUs())
+
+	max = CPUMax("max 10000")
+	assert.Equal(t, int64(-1), max.Quota())
+	assert.Equal(t, uint64(10000), max.Period())
+	assert.True(t, max.IsUnlimited())
+	assert.Equal(t, float64(-1), max.CPUs())
+}
 
-	// case with nil quota which makes it "max" - max int val
-	cpuMax2 := NewCPUMax(nil, &period)
-	tquota2, tPeriod2 := cpuMax2.extractQuotaAndPeriod()
+func TestNewCPUMaxFromCPUs(t *testing.T) {
+	assert.Equal(t, CPUMax("150000 100000"), NewCPUMaxFromCPUs(1.5, 0))
+	assert.Equal(t, CPUMax("3334 10000"), NewCPUMaxFromCPUs(1.0/3, 10000))
+	assert.Equal(t, CPUMax("max 10000"), NewCPUMaxFromCPUs(0, 10000))
+}
 
-	assert.Equal(t, int64(math.MaxInt64), tquota2)
-	assert.Equal(t, period, tPeriod2)
+func TestCPUQuotaPerSecUSec(t *testing.T) {
+	for max, expected := range map[CPUMax]uint64{
+		"max 100000":    math.MaxUint64,
+		"50000 100000":  500000,
+		"10000 8000":    1250000,
+		"1001 100000":   20000,
+		"150000 100000": 1500000,
+	} {
+		assert.Equal(t, expected, max.CPUQuotaPerSecUSec(), string(max))
+	}
 }
@@ -0,0 +1,273 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// delegatedFiles are the files of a cgroup that the owner of a delegated subtree
+// needs to be able to write. They are used when the kernel doesn't list them in
+// kernelDelegateFile (kernels older than 4.15).
+var delegatedFiles = []string{cgroupProcs, subtreeControl, cgroupThreads}
+
+// kernelDelegateFile lists the files of a cgroup the kernel expects to be
+// delegated.
+const kernelDelegateFile = "/sys/kernel/cgroup/delegate"
+
+// delegateFiles returns the files of a cgroup to chown when delegating it.
+func (c *Manager) delegateFiles() ([]string, error) {
+	file := c.delegateFile
+	if file == "" {
+		file = kernelDelegateFile
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return delegatedFiles, nil
+		}
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// Delegate hands the cgroup over to uid and gid: the cgroup directory and the
+// files listed in /sys/kernel/cgroup/delegate are chowned, which allows the user
+// to create child cgroups, to enable controllers for them and to move processes
+// between them. Files the kernel did not create for the cgroup, like the files
+// of controllers that are not enabled, are skipped.
+//
+// The ancestors of the cgroup are left untouched: to move processes into the
+// cgroup, the user must also be able to write the cgroup.procs file of the common
+// ancestor of the source and destination cgroups.
+func (c *Manager) Delegate(uid, gid int) error {
+	files, err := c.delegateFiles()
+	if err != nil {
+		return err
+	}
+	if err := c.chown(".", uid, gid); err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err := c.chown(name, uid, gid); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Undelegate reverts Delegate, giving the cgroup back to the owner of its parent.
+func (c *Manager) Undelegate() error {
+	var st unix.Stat_t
+	parent := filepath.Dir(c.path)
+	if c.dir == nil {
+		if err := unix.Stat(parent, &st); err != nil {
+			return &os.PathError{Op: "stat", Path: parent, Err: err}
+		}
+	} else {
+		dir, _, err := c.openParent()
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+		if err := unix.Fstat(int(dir.Fd()), &st); err != nil {
+			return &os.PathError{Op: "fstat", Path: parent, Err: err}
+		}
+	}
+	return c.Delegate(int(st.Uid), int(st.Gid))
+}
+
+// chown changes the owner of the named file of the cgroup without following
+// symlinks.
+func (c *Manager) chown(name string, uid, gid int) error {
+	if c.dir == nil {
+		return os.Lchown(filepath.Join(c.path, name), uid, gid)
+	}
+	flags := unix.AT_SYMLINK_NOFOLLOW
+	if name == "." {
+		name, flags = "", unix.AT_EMPTY_PATH
+	}
+	if err := unix.Fchownat(int(c.dir.Fd()), name, uid, gid, flags); err != nil {
+		return &os.PathError{Op: "fchownat", Path: filepath.Join(c.path, name), Err: err}
+	}
+	return nil
+}
+
+// DelegationReport describes what the current user is allowed to do with a cgroup.
+type DelegationReport struct {
+	// Path is the full path of the cgroup.
+	Path string
+	// Root is the full path of the topmost ancestor, or the cgroup itself, which
+	// the current user can move processes into without leaving the cgroups it
+	// has write access to. It is empty if the user can't write the cgroup.procs
+	// file of the cgroup.
+	Root string
+	// Writable reports, for cgroup.procs, cgroup.subtree_control and
+	// cgroup.threads, whether the current user can write the file of the cgroup.
+	Writable map[string]bool
+	// Ancestors lists the controllers of every cgroup from the root of the
+	// unified hierarchy down to, and including, the cgroup.
+	Ancestors []AncestorControllers
+	// NsDelegate is set when the hierarchy is mounted with the nsdelegate
+	// option, which makes cgroup namespaces delegation boundaries.
+	NsDelegate bool
+}
+
+// AncestorControllers lists the controllers of a cgroup.
+type AncestorControllers struct {
+	// Path is the full path of the cgroup.
+	Path string
+	// Available are the controllers listed in cgroup.controllers, which may
+	// be enabled for the children of the cgroup.
+	Available []string
+	// Enabled are the controllers listed in cgroup.subtree_control, which are
+	// enabled for the children of the cgroup.
+	Enabled []string
+}
+
+// Unavailable returns the topmost ancestor that controller is not available in,
+// or nil if the controller can be enabled for the cgroup.
+func (r *DelegationReport) Unavailable(controller string) *AncestorControllers {
+	// the last entry is the cgroup itself
+	for i := 0; i < len(r.Ancestors)-1; i++ {
+		if !contains(r.Ancestors[i].Available, controller) {
+			return &r.Ancestors[i]
+		}
+	}
+	return nil
+}
+
+// Delegation reports what the current user is allowed to do with group, which
+// is useful to find out why a rootless user can't create cgroups or enable
+// controllers.
+func Delegation(group string, opts ...InitOpts) (*DelegationReport, error) {
+	c := InitConfig{mountpoint: defaultCgroup2Path}
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return nil, err
+		}
+	}
+	if err := VerifyGroupPath(group); err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		unifiedMountpoint: c.mountpoint,
+		path:              filepath.Join(c.mountpoint, group),
+	}
+	report := &DelegationReport{
+		Path:     m.path,
+		Writable: make(map[string]bool, len(delegatedFiles)),
+	}
+	for _, name := range delegatedFiles {
+		report.Writable[name] = writable(filepath.Join(m.path, name))
+	}
+	if report.Writable[cgroupProcs] {
+		// moving processes between two cgroups requires write access to the
+		// cgroup.procs file of their common ancestor
+		report.Root = m.path
+		ancestors := m.ancestors()
+		for i := len(ancestors) - 1; i >= 0; i-- {
+			if !writable(filepath.Join(ancestors[i], cgroupProcs)) {
+				break
+			}
+			report.Root = ancestors[i]
+		}
+	}
+	for _, path := range append(m.ancestors(), m.path) {
+		available, err := readControllers(filepath.Join(path, controllersFile))
+		if err != nil {
+			return nil, err
+		}
+		enabled, err := readControllers(filepath.Join(path, subtreeControl))
+		if err != nil {
+			return nil, err
+		}
+		report.Ancestors = append(report.Ancestors, AncestorControllers{
+			Path:      path,
+			Available: available,
+			Enabled:   enabled,
+		})
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if report.NsDelegate, err = nsDelegate(f, c.mountpoint); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// writable reports whether the current user can write path, taking the effective
+// uid and gid into account.
+func writable(path string) bool {
+	return unix.Faccessat(unix.AT_FDCWD, path, unix.W_OK, unix.AT_EACCESS) == nil
+}
+
+func readControllers(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// nsDelegate reports whether the cgroup2 file system at mountpoint is mounted
+// with the nsdelegate option, reading the mountinfo from r.
+func nsDelegate(r io.Reader, mountpoint string) (bool, error) {
+	var (
+		delegate bool
+		s        = bufio.NewScanner(r)
+	)
+	mountpoint = filepath.Clean(mountpoint)
+	for s.Scan() {
+		var (
+			text   = s.Text()
+			fields = strings.Fields(text)
+		)
+		// optional fields are terminated by a single hyphen, followed by the
+		// file system type, the mount source and the super block options
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep == -1 || len(fields) < sep+4 {
+			return false, fmt.Errorf("mountinfo: bad entry %q", text)
+		}
+		// the last entry wins when several file systems are mounted on top of
+		// each other
+		if fields[4] == mountpoint && fields[sep+1] == "cgroup2" {
+			delegate = contains(strings.Split(fields[sep+3], ","), "nsdelegate")
+		}
+	}
+	return delegate, s.Err()
+}
@@ -0,0 +1,157 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNsDelegate(t *testing.T) {
+	const mountinfo = `22 1 0:21 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+26 22 0:23 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:4 - cgroup2 cgroup2 rw,nsdelegate,memory_recursiveprot
+27 22 0:24 / /sys/fs/cgroup/unified rw,nosuid,nodev,noexec,relatime shared:5 - cgroup2 cgroup2 rw
+`
+	delegate, err := nsDelegate(strings.NewReader(mountinfo), "/sys/fs/cgroup")
+	require.NoError(t, err)
+	assert.True(t, delegate)
+
+	delegate, err = nsDelegate(strings.NewReader(mountinfo), "/sys/fs/cgroup/unified/")
+	require.NoError(t, err)
+	assert.False(t, delegate)
+
+	_, err = nsDelegate(strings.NewReader("26 22 0:23 /\n"), "/sys/fs/cgroup")
+	assert.Error(t, err)
+}
+
+// fakeHierarchy creates root/user/app with the cpu controller delegated to user,
+// and the memory controller only available in root.
+func fakeHierarchy(t *testing.T) string {
+	root := t.TempDir()
+	for dir, controllers := range map[string]string{
+		root:                               "cpu memory",
+		filepath.Join(root, "user"):        "cpu",
+		filepath.Join(root, "user", "app"): "",
+	} {
+		require.NoError(t, os.MkdirAll(dir, defaultDirPerm))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, controllersFile), []byte(controllers+"\n"), 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, cgroupProcs), nil, 0o644))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(root, subtreeControl), []byte("cpu\n"), 0o644))
+	return root
+}
+
+func TestDelegation(t *testing.T) {
+	root := fakeHierarchy(t)
+	report, err := Delegation("/user/app", WithMountpoint(root))
+	require.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(root, "user", "app"), report.Path)
+	assert.True(t, report.Writable[cgroupProcs])
+	assert.False(t, report.Writable[subtreeControl], "missing files are not writable")
+	if os.Getuid() == 0 {
+		assert.Equal(t, root, report.Root)
+	}
+	require.Len(t, report.Ancestors, 3)
+	assert.Equal(t, []string{"cpu", "memory"}, report.Ancestors[0].Available)
+	assert.Equal(t, []string{"cpu"}, report.Ancestors[0].Enabled)
+	assert.Empty(t, report.Ancestors[1].Enabled)
+
+	assert.Nil(t, report.Unavailable("cpu"))
+	unavailable := report.Unavailable("memory")
+	require.NotNil(t, unavailable)
+	assert.Equal(t, filepath.Join(root, "user"), unavailable.Path)
+}
+
+func TestToggleControllersUnavailable(t *testing.T) {
+	root := fakeHierarchy(t)
+	m := &Manager{unifiedMountpoint: root, path: filepath.Join(root, "user", "app")}
+
+	// user has no cgroup.subtree_control, as if it couldn't be written
+	err := m.ToggleControllers([]string{"memory"}, Enable)
+	var unavailable *ErrControllerUnavailable
+	require.True(t, errors.As(err, &unavailable), "unexpected error %v", err)
+	assert.Equal(t, "memory", unavailable.Controller)
+	assert.Equal(t, filepath.Join(root, "user"), unavailable.Ancestor)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	err = m.ToggleControllers([]string{"cpu"}, Enable)
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &unavailable))
+}
+
+func testDelegate(t *testing.T, dirFD bool) {
+	if os.Getuid() != 0 {
+		t.Skip("chown requires root")
+	}
+	root := fakeMountpoint(t)
+	delegate := filepath.Join(t.TempDir(), "delegate")
+	require.NoError(t, os.WriteFile(delegate, []byte("cgroup.procs\ncgroup.threads\ncgroup.subtree_control\nmemory.oom.group\n"), 0o644))
+	opts := []InitOpts{WithMountpoint(root), func(c *InitConfig) error {
+		c.delegateFile = delegate
+		return nil
+	}}
+	if dirFD {
+		opts = append(opts, fakeDirFD(t, root))
+	}
+	path := filepath.Join(root, "user")
+	require.NoError(t, os.Mkdir(path, defaultDirPerm))
+	for _, name := range []string{cgroupProcs, cgroupThreads, subtreeControl, "memory.max"} {
+		require.NoError(t, os.WriteFile(filepath.Join(path, name), nil, 0o644))
+	}
+
+	m, err := Load("/user", opts...)
+	require.NoError(t, err)
+	defer m.Close()
+
+	owner := func(name string) (uint32, uint32) {
+		fi, err := os.Lstat(filepath.Join(path, name))
+		require.NoError(t, err)
+		st := fi.Sys().(*syscall.Stat_t)
+		return st.Uid, st.Gid
+	}
+	require.NoError(t, m.Delegate(1000, 1001))
+	for _, name := range []string{".", cgroupProcs, cgroupThreads, subtreeControl} {
+		uid, gid := owner(name)
+		assert.Equal(t, uint32(1000), uid, name)
+		assert.Equal(t, uint32(1001), gid, name)
+	}
+	uid, _ := owner("memory.max")
+	assert.Equal(t, uint32(0), uid, "files not listed by the kernel are not delegated")
+
+	require.NoError(t, m.Undelegate())
+	for _, name := range []string{".", cgroupProcs, cgroupThreads, subtreeControl} {
+		uid, gid := owner(name)
+		assert.Equal(t, uint32(0), uid, name)
+		assert.Equal(t, uint32(0), gid, name)
+	}
+}
+
+func TestDelegate(t *testing.T) {
+	testDelegate(t, false)
+}
+
+func TestDelegateDirFD(t *testing.T) {
+	testDelegate(t, true)
+}
@@ -0,0 +1,463 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/cgroups/v3"
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
+
+	"golang.org/x/sys/unix"
+)
+
+// openat2Unsupported is set once openat2(2) returned ENOSYS (kernels older than
+// 5.6), or EPERM when a seccomp filter blocks it, as is common inside containers.
+var openat2Unsupported int32
+
+// openMountpoint opens the unified mountpoint as an O_PATH directory and checks
+// that it is on a file system of type fsType, the cgroup2 one when 0.
+func openMountpoint(mountpoint string, fsType int64) (*os.File, error) {
+	if fsType == 0 {
+		fsType = unix.CGROUP2_SUPER_MAGIC
+	}
+	mnt, err := os.OpenFile(mountpoint, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(int(mnt.Fd()), &st); err != nil {
+		mnt.Close()
+		return nil, &os.PathError{Op: "fstatfs", Path: mountpoint, Err: err}
+	}
+	if int64(st.Type) != fsType {
+		mnt.Close()
+		return nil, fmt.Errorf("cgroups: %q is not a cgroup2 mountpoint", mountpoint)
+	}
+	return mnt, nil
+}
+
+// relativeGroup returns group relative to the mountpoint, for use with openat.
+func relativeGroup(group string) string {
+	if rel := strings.TrimPrefix(group, "/"); rel != "" {
+		return rel
+	}
+	return "."
+}
+
+// openat opens name relative to dir. The lookup never follows symlinks, and never
+// leaves dir or the file system dir lives on. openat2(2) is used to enforce this
+// when the kernel supports it; on older kernels name is resolved one component
+// at a time with O_NOFOLLOW, and the result is verified to be on the same device.
+func openat(dir *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+	path := filepath.Join(dir.Name(), name)
+	if atomic.LoadInt32(&openat2Unsupported) == 0 {
+		how := &unix.OpenHow{
+			Flags:   uint64(flag | unix.O_CLOEXEC),
+			Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS | unix.RESOLVE_NO_XDEV,
+		}
+		if flag&unix.O_CREAT != 0 {
+			how.Mode = uint64(perm.Perm())
+		}
+		var (
+			fd  int
+			err error
+		)
+		// EAGAIN is returned when a rename raced with the lookup
+		for i := 0; i < 5; i++ {
+			if fd, err = unix.Openat2(int(dir.Fd()), name, how); !errors.Is(err, unix.EAGAIN) {
+				break
+			}
+		}
+		if err == nil {
+			return os.NewFile(uintptr(fd), path), nil
+		}
+		if !errors.Is(err, unix.ENOSYS) && !errors.Is(err, unix.EPERM) {
+			return nil, &os.PathError{Op: "openat2", Path: path, Err: err}
+		}
+		atomic.StoreInt32(&openat2Unsupported, 1)
+	}
+	return openatFallback(dir, name, flag, perm)
+}
+
+func openatFallback(dir *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+	path := filepath.Join(dir.Name(), name)
+	if filepath.IsAbs(name) {
+		return nil, &os.PathError{Op: "openat", Path: path, Err: unix.EXDEV}
+	}
+	var parentSt unix.Stat_t
+	if err := unix.Fstat(int(dir.Fd()), &parentSt); err != nil {
+		return nil, &os.PathError{Op: "fstat", Path: dir.Name(), Err: err}
+	}
+	components := strings.Split(name, "/")
+	cur := int(dir.Fd())
+	for i, component := range components {
+		if component == ".." {
+			return nil, &os.PathError{Op: "openat", Path: path, Err: unix.EXDEV}
+		}
+		last := i == len(components)-1
+		flags := unix.O_PATH | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+		if last {
+			flags = flag | unix.O_NOFOLLOW | unix.O_CLOEXEC
+		}
+		fd, err := unix.Openat(cur, component, flags, uint32(perm.Perm()))
+		if cur != int(dir.Fd()) {
+			unix.Close(cur)
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "openat", Path: path, Err: err}
+		}
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			unix.Close(fd)
+			return nil, &os.PathError{Op: "fstat", Path: path, Err: err}
+		}
+		if st.Dev != parentSt.Dev {
+			unix.Close(fd)
+			return nil, &os.PathError{Op: "openat", Path: path, Err: unix.EXDEV}
+		}
+		if last {
+			return os.NewFile(uintptr(fd), path), nil
+		}
+		cur = fd
+	}
+	// unreachable, strings.Split always returns at least one component
+	return nil, &os.PathError{Op: "openat", Path: path, Err: unix.EINVAL}
+}
+
+// mkdirAllAt creates the directory name, along with any missing parents, relative
+// to dir and returns it opened as an O_PATH directory.
+func mkdirAllAt(dir *os.File, name string) (*os.File, error) {
+	cur := dir
+	for _, component := range strings.Split(filepath.Clean(name), "/") {
+		if component == "." {
+			continue
+		}
+		if err := unix.Mkdirat(int(cur.Fd()), component, defaultDirPerm); err != nil && !errors.Is(err, unix.EEXIST) {
+			if cur != dir {
+				cur.Close()
+			}
+			return nil, &os.PathError{Op: "mkdirat", Path: filepath.Join(cur.Name(), component), Err: err}
+		}
+		next, err := openat(cur, component, unix.O_PATH|unix.O_DIRECTORY, 0)
+		if cur != dir {
+			cur.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		cur = next
+	}
+	if cur == dir {
+		return openat(dir, ".", unix.O_PATH|unix.O_DIRECTORY, 0)
+	}
+	return cur, nil
+}
+
+// rmdirAt removes the empty directory name relative to dir. Only the last
+// component of name is removed, its parent is opened with openat.
+func rmdirAt(dir *os.File, name string) error {
+	parent, base := filepath.Dir(name), filepath.Base(name)
+	if parent != "." {
+		d, err := openat(dir, parent, unix.O_PATH|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		dir = d
+	}
+	if err := unix.Unlinkat(int(dir.Fd()), base, unix.AT_REMOVEDIR); err != nil {
+		return &os.PathError{Op: "unlinkat", Path: filepath.Join(dir.Name(), base), Err: err}
+	}
+	return nil
+}
+
+// removeAt removes the directory name of dir along with its content, like
+// remove does with os.RemoveAll, without following symlinks.
+func removeAt(dir *os.File, name string) error {
+	var err error
+	delay := 10 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		if i != 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = removeTreeAt(dir, name); err == nil {
+			return nil
+		}
+	}
+	return cgroups.NewError("remove", filepath.Join(dir.Name(), name), "", "", err)
+}
+
+func removeTreeAt(dir *os.File, name string) error {
+	err := unix.Unlinkat(int(dir.Fd()), name, unix.AT_REMOVEDIR)
+	if err == nil || errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	if !errors.Is(err, unix.EBUSY) && !errors.Is(err, unix.ENOTEMPTY) && !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	// the child cgroups are removed first, the errors of the files are
+	// ignored as long as the directory can be removed in the end
+	d, oerr := openat(dir, name, os.O_RDONLY|unix.O_DIRECTORY, 0)
+	if oerr != nil {
+		return err
+	}
+	entries, _ := d.ReadDir(-1)
+	for _, e := range entries {
+		if e.IsDir() {
+			_ = removeTreeAt(d, e.Name())
+		} else {
+			_ = unix.Unlinkat(int(d.Fd()), e.Name(), 0)
+		}
+	}
+	d.Close()
+	if err := unix.Unlinkat(int(dir.Fd()), name, unix.AT_REMOVEDIR); err != nil && !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	return nil
+}
+
+// mountpointDir opens the mountpoint of a manager holding a directory file
+// descriptor, so that the other cgroups are opened relative to it. It returns
+// nil for the other managers.
+func (c *Manager) mountpointDir() (*os.File, error) {
+	if c.dir == nil {
+		return nil, nil
+	}
+	return openMountpoint(c.unifiedMountpoint, c.fsType)
+}
+
+// openParent opens the parent directory of a cgroup held by a directory file
+// descriptor, relative to the mountpoint, and returns the name of the cgroup
+// in it. It fails when that name no longer is the directory of the cgroup,
+// e.g. because the cgroup was moved.
+func (c *Manager) openParent() (*os.File, string, error) {
+	mnt, err := openMountpoint(c.unifiedMountpoint, c.fsType)
+	if err != nil {
+		return nil, "", err
+	}
+	defer mnt.Close()
+	rel, err := filepath.Rel(c.unifiedMountpoint, c.path)
+	if err != nil {
+		return nil, "", err
+	}
+	parent, name := filepath.Dir(rel), filepath.Base(rel)
+	dir, err := openat(mnt, parent, unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var want, got unix.Stat_t
+	if err := unix.Fstat(int(c.dir.Fd()), &want); err != nil {
+		dir.Close()
+		return nil, "", &os.PathError{Op: "fstat", Path: c.path, Err: err}
+	}
+	if err := unix.Fstatat(int(dir.Fd()), name, &got, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		dir.Close()
+		return nil, "", &os.PathError{Op: "fstatat", Path: c.path, Err: err}
+	}
+	if got.Dev != want.Dev || got.Ino != want.Ino {
+		dir.Close()
+		return nil, "", fmt.Errorf("cgroups: %q is no longer the directory of the cgroup", c.path)
+	}
+	return dir, name, nil
+}
+
+// removeChild removes the directory of the child cgroup name that couldn't be
+// set up.
+func (c *Manager) removeChild(name string) {
+	if c.dir == nil {
+		os.Remove(filepath.Join(c.path, name))
+		return
+	}
+	_ = rmdirAt(c.dir, name)
+}
+
+// addWatch adds an IN_MODIFY inotify watch of the named file of the cgroup to
+// fd. When the manager holds a directory file descriptor, the file is opened
+// with openat and watched through its /proc/self/fd link.
+func (c *Manager) addWatch(fd int, name string) (int, error) {
+	if c.dir == nil {
+		path := filepath.Join(c.path, name)
+		wd, err := unix.InotifyAddWatch(fd, path, unix.IN_MODIFY)
+		if err != nil {
+			return 0, fmt.Errorf("failed to add inotify watch for %q: %w", path, err)
+		}
+		return wd, nil
+	}
+	f, err := c.open(name, unix.O_PATH)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	wd, err := unix.InotifyAddWatch(fd, fmt.Sprintf("/proc/self/fd/%d", f.Fd()), unix.IN_MODIFY)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add inotify watch for %q: %w", f.Name(), err)
+	}
+	return wd, nil
+}
+
+// open opens the named file of the cgroup. When the manager holds a directory
+// file descriptor, the file is opened relative to it with openat.
+func (c *Manager) open(name string, flag int) (*os.File, error) {
+	if c.dir != nil {
+		return openat(c.dir, name, flag, c.filePerm)
+	}
+	return os.OpenFile(filepath.Join(c.path, name), flag, c.filePerm)
+}
+
+func (c *Manager) readFile(name string) ([]byte, error) {
+	if c.dir == nil {
+		data, err := os.ReadFile(filepath.Join(c.path, name))
+		if err != nil {
+			return nil, cgroups.NewError("read", c.path, name, "", err)
+		}
+		return data, nil
+	}
+	f, err := c.open(name, os.O_RDONLY)
+	if err != nil {
+		return nil, cgroups.NewError("read", c.path, name, "", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, cgroups.NewError("read", c.path, name, "", err)
+	}
+	return data, nil
+}
+
+func (c *Manager) writeValues(values []Value) error {
+	if c.dir == nil {
+		return writeValues(c.path, c.filePerm, values)
+	}
+	for _, o := range values {
+		data, err := o.data()
+		if err != nil {
+			return cgroups.NewError("write", c.path, o.filename, "", err)
+		}
+		f, err := c.open(o.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return cgroups.NewError("write", c.path, o.filename, string(data), err)
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return cgroups.NewError("write", c.path, o.filename, string(data), err)
+		}
+	}
+	return nil
+}
+
+// statUint64 returns the single value of a stat file of the cgroup, or 0 when it
+// can't be read.
+func (c *Manager) statUint64(name string) uint64 {
+	f, err := c.open(name, os.O_RDONLY)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	return readStatUint64(f, c.log())
+}
+
+func (c *Manager) statPSI(name string) *stats.PSIStats {
+	f, err := c.open(name, os.O_RDONLY)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return readStatPSI(f, c.log())
+}
+
+func (c *Manager) ioStats() []*stats.IOEntry {
+	data, err := c.readFile("io.stat")
+	if err != nil {
+		return nil
+	}
+	return parseIoStats(data)
+}
+
+func (c *Manager) rdmaStats(name string) []*stats.RdmaEntry {
+	data, err := c.readFile(name)
+	if err != nil {
+		return []*stats.RdmaEntry{}
+	}
+	return toRdmaEntry(strings.Split(string(data), "\n"))
+}
+
+// walkTasksAt is the directory file descriptor based counterpart of walkTasks.
+func walkTasksAt(dir *os.File, path string, recursive bool, tType string, fn func(path string, tasks []uint64) error) error {
+	f, err := openat(dir, tType, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	tasks, err := parseCgroupTasks(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err := fn(path, tasks); err != nil {
+		return err
+	}
+	if !recursive {
+		return nil
+	}
+	// O_PATH descriptors can't be used to list a directory
+	d, err := openat(dir, ".", os.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	entries, err := d.ReadDir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		sub, err := openat(dir, e.Name(), unix.O_PATH|unix.O_DIRECTORY, 0)
+		if err != nil {
+			return err
+		}
+		err = walkTasksAt(sub, filepath.Join(path, e.Name()), recursive, tType, fn)
+		sub.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases the directory file descriptor held by a manager created with
+// WithDirFD. It is a no-op for other managers.
+func (c *Manager) Close() error {
+	if c.dir == nil {
+		return nil
+	}
+	err := c.dir.Close()
+	c.dir = nil
+	return err
+}
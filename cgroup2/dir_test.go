@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// fakeMountpoint returns a temporary directory to use as the unified mountpoint.
+func fakeMountpoint(t *testing.T) string {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, subtreeControl), nil, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, controllersFile), []byte("cpu memory\n"), 0o644))
+	return root
+}
+
+// fakeDirFD is WithDirFD for the managers to accept the fake mountpoint root as
+// a cgroup2 mountpoint.
+func fakeDirFD(t *testing.T, root string) InitOpts {
+	var st unix.Statfs_t
+	require.NoError(t, unix.Statfs(root, &st))
+	return func(c *InitConfig) error {
+		c.dirFD = true
+		c.fsType = int64(st.Type)
+		return nil
+	}
+}
+
+func testDirFD(t *testing.T) {
+	root := fakeMountpoint(t)
+	dirFD := fakeDirFD(t, root)
+	m, err := NewManager(root, "/child", &Resources{}, dirFD)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	require.NotNil(t, m.dir)
+
+	pid := os.Getpid()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "child", cgroupProcs), []byte(fmt.Sprintf("%d\n", pid)), 0o644))
+	procs, err := m.Procs(false)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{uint64(pid)}, procs)
+
+	require.NoError(t, os.WriteFile(filepath.Join(root, "child", typeFile), nil, 0o644))
+	require.NoError(t, m.SetType(Threaded))
+	cgType, err := m.GetType()
+	require.NoError(t, err)
+	assert.Equal(t, Threaded, cgType)
+
+	// the cgroup is moved away and a symlink planted in its place
+	require.NoError(t, os.Rename(filepath.Join(root, "child"), filepath.Join(root, "moved")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "moved"), filepath.Join(root, "child")))
+	_, err = Load("/child", WithMountpoint(root), dirFD)
+	assert.Error(t, err, "the symlink must not be followed")
+
+	// the open manager keeps addressing the directory it was created with
+	cgType, err = m.GetType()
+	require.NoError(t, err)
+	assert.Equal(t, Threaded, cgType)
+
+	// symlinks inside of the cgroup are refused as well
+	require.NoError(t, os.Symlink("/etc/hostname", filepath.Join(root, "moved", "memory.max")))
+	assert.Error(t, m.writeValues([]Value{{filename: "memory.max", value: "max"}}))
+	_, err = m.readFile("../" + subtreeControl)
+	assert.Error(t, err, "lookups must stay beneath the cgroup")
+
+	child, err := m.NewChild("leaf", nil)
+	require.NoError(t, err)
+	defer child.Close()
+	assert.DirExists(t, filepath.Join(root, "moved", "leaf"))
+
+	controllers, err := child.RootControllers()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cpu", "memory"}, controllers)
+
+	// the controllers can't be enabled without subtree_control, the directory
+	// of the child is removed
+	_, err = child.NewChild("failed", &Resources{Memory: &Memory{Max: int64Ptr(1 << 30)}})
+	assert.Error(t, err)
+	assert.NoDirExists(t, filepath.Join(root, "moved", "leaf", "failed"))
+
+	// Delete doesn't remove what was planted in place of the moved cgroup
+	require.NoError(t, os.WriteFile(filepath.Join(root, "moved", "leaf", cgroupProcs), nil, 0o644))
+	require.NoError(t, os.Remove(filepath.Join(root, "child")))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "child", "leaf"), defaultDirPerm))
+	assert.Error(t, child.Delete())
+	assert.DirExists(t, filepath.Join(root, "child", "leaf"))
+
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "child")))
+	require.NoError(t, os.Rename(filepath.Join(root, "moved"), filepath.Join(root, "child")))
+	require.NoError(t, child.Delete())
+	assert.NoDirExists(t, filepath.Join(root, "child", "leaf"))
+}
+
+func TestDirFD(t *testing.T) {
+	testDirFD(t)
+}
+
+func TestDirFDWithoutOpenat2(t *testing.T) {
+	atomic.StoreInt32(&openat2Unsupported, 1)
+	defer atomic.StoreInt32(&openat2Unsupported, 0)
+	testDirFD(t)
+}
+
+func TestDirFDRemoveAt(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "a", "b", "c"), defaultDirPerm))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "a", "b", "memory.max"), nil, 0o644))
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "keep"), nil, 0o644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "a", "link")))
+
+	dir, err := os.OpenFile(root, unix.O_PATH|unix.O_DIRECTORY, 0)
+	require.NoError(t, err)
+	defer dir.Close()
+	require.NoError(t, removeAt(dir, "a"))
+	assert.NoDirExists(t, filepath.Join(root, "a"))
+	assert.FileExists(t, filepath.Join(outside, "keep"), "symlinks must not be followed")
+	require.NoError(t, removeAt(dir, "a"), "removing a missing directory is not an error")
+}
+
+func TestDirFDRejectsOtherFilesystems(t *testing.T) {
+	_, err := Load("/", WithMountpoint(t.TempDir()), WithDirFD())
+	assert.Error(t, err)
+}
@@ -17,7 +17,11 @@
 package cgroup2
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/asm"
@@ -26,16 +30,39 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// deviceFilterName is the name of the programs loaded by
+// LoadAttachCgroupDeviceFilter, which tells them apart from the device
+// programs attached by others, like systemd.
+const deviceFilterName = "cgroups_devices"
+
 // LoadAttachCgroupDeviceFilter installs eBPF device filter program to /sys/fs/cgroup/<foo> directory.
+// The device programs previously attached to the cgroup by this function are
+// replaced, so that the rules they allowed stop taking effect. The programs
+// attached by others, like systemd, are left alone.
 //
 // Requires the system to be running in cgroup2 unified-mode with kernel >= 4.15 .
+// The old programs are found with BPF_PROG_QUERY (kernel >= 4.19) and atomically
+// replaced with BPF_F_REPLACE (kernel >= 5.6), or detached after the new program
+// is attached on older kernels.
 //
 // https://github.com/torvalds/linux/commit/ebc614f687369f9df99828572b1d85a7c2de3d92
 func LoadAttachCgroupDeviceFilter(insts asm.Instructions, license string, dirFD int) (func() error, error) {
 	nilCloser := func() error {
 		return nil
 	}
+	oldProgs, err := findAttachedCgroupDeviceFilters(dirFD)
+	if err != nil {
+		// without BPF_PROG_QUERY the old programs can't be found, and stay attached
+		oldProgs = nil
+	}
+	oldProgs = ownDeviceFilters(oldProgs)
+	defer func() {
+		for _, old := range oldProgs {
+			old.Close()
+		}
+	}()
 	spec := &ebpf.ProgramSpec{
+		Name:         deviceFilterName,
 		Type:         ebpf.CGroupDevice,
 		Instructions: insts,
 		License:      license,
@@ -44,29 +71,146 @@ func LoadAttachCgroupDeviceFilter(insts asm.Instructions, license string, dirFD
 	if err != nil {
 		return nilCloser, err
 	}
-	err = link.RawAttachProgram(link.RawAttachProgramOptions{
-		Target:  dirFD,
-		Program: prog,
-		Attach:  ebpf.AttachCGroupDevice,
-		Flags:   unix.BPF_F_ALLOW_MULTI,
-	})
+	// the attached program is kept by the kernel, the closer reopens it by ID
+	defer prog.Close()
+	info, err := prog.Info()
 	if err != nil {
-		return nilCloser, fmt.Errorf("failed to call BPF_PROG_ATTACH (BPF_CGROUP_DEVICE, BPF_F_ALLOW_MULTI): %w", err)
+		return nilCloser, err
 	}
-	closer := func() error {
-		err = link.RawDetachProgram(link.RawDetachProgramOptions{
+	id, ok := info.ID()
+	if !ok {
+		return nilCloser, fmt.Errorf("cannot get the ID of the device filter program")
+	}
+
+	attach := func(replace *ebpf.Program) error {
+		flags := unix.BPF_F_ALLOW_MULTI
+		if replace != nil {
+			flags |= unix.BPF_F_REPLACE
+		}
+		return link.RawAttachProgram(link.RawAttachProgramOptions{
 			Target:  dirFD,
 			Program: prog,
 			Attach:  ebpf.AttachCGroupDevice,
+			Replace: replace,
+			Flags:   uint32(flags),
 		})
+	}
+	var replaced *ebpf.Program
+	if len(oldProgs) == 1 {
+		// BPF_F_REPLACE swaps the programs without a window where neither or
+		// both of them are effective
+		if err := attach(oldProgs[0]); err == nil {
+			replaced = oldProgs[0]
+		} else if !errors.Is(err, unix.EINVAL) {
+			return nilCloser, fmt.Errorf("failed to call BPF_PROG_ATTACH (BPF_CGROUP_DEVICE, BPF_F_ALLOW_MULTI|BPF_F_REPLACE): %w", err)
+		}
+	}
+	if replaced == nil {
+		if err := attach(nil); err != nil {
+			return nilCloser, fmt.Errorf("failed to call BPF_PROG_ATTACH (BPF_CGROUP_DEVICE, BPF_F_ALLOW_MULTI): %w", err)
+		}
+	}
+	closer := func() error {
+		prog, err := ebpf.NewProgramFromID(id)
 		if err != nil {
-			return fmt.Errorf("failed to call BPF_PROG_DETACH (BPF_CGROUP_DEVICE): %w", err)
+			return fmt.Errorf("cannot get the device filter program: %w", err)
+		}
+		defer prog.Close()
+		return detachCgroupDeviceFilter(dirFD, prog)
+	}
+	for _, old := range oldProgs {
+		if old == replaced {
+			continue
+		}
+		if err := detachCgroupDeviceFilter(dirFD, old); err != nil {
+			return closer, err
 		}
-		return nil
 	}
 	return closer, nil
 }
 
+// ownDeviceFilters returns the programs of progs loaded by
+// LoadAttachCgroupDeviceFilter, recognized by their name, and closes the
+// others. The kernels without program names (older than 4.15) have none.
+func ownDeviceFilters(progs []*ebpf.Program) []*ebpf.Program {
+	var own []*ebpf.Program
+	for _, prog := range progs {
+		if info, err := prog.Info(); err == nil && info.Name == deviceFilterName {
+			own = append(own, prog)
+		} else {
+			prog.Close()
+		}
+	}
+	return own
+}
+
+func detachCgroupDeviceFilter(dirFD int, prog *ebpf.Program) error {
+	err := link.RawDetachProgram(link.RawDetachProgramOptions{
+		Target:  dirFD,
+		Program: prog,
+		Attach:  ebpf.AttachCGroupDevice,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to call BPF_PROG_DETACH (BPF_CGROUP_DEVICE): %w", err)
+	}
+	return nil
+}
+
+// bpfProgQueryAttr is the BPF_PROG_QUERY part of union bpf_attr
+type bpfProgQueryAttr struct {
+	targetFD    uint32
+	attachType  uint32
+	queryFlags  uint32
+	attachFlags uint32
+	progIDs     uint64
+	progCount   uint32
+	_           uint32
+}
+
+// findAttachedCgroupDeviceFilters returns the device programs attached to the
+// cgroup of dirFD. The programs which can't be opened, e.g. because of the
+// permissions, are skipped.
+func findAttachedCgroupDeviceFilters(dirFD int) ([]*ebpf.Program, error) {
+	// a cgroup can have at most 64 programs of a type attached, so the first
+	// query almost never runs out of space
+	ids := make([]uint32, 64)
+	for {
+		attr := bpfProgQueryAttr{
+			targetFD:   uint32(dirFD),
+			attachType: uint32(ebpf.AttachCGroupDevice),
+			progIDs:    uint64(uintptr(unsafe.Pointer(&ids[0]))),
+			progCount:  uint32(len(ids)),
+		}
+		_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_QUERY, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+		runtime.KeepAlive(ids)
+		if errno == unix.ENOSPC && int(attr.progCount) > len(ids) {
+			// the count is set to the number of attached programs
+			ids = make([]uint32, attr.progCount)
+			continue
+		}
+		if errno != 0 {
+			return nil, fmt.Errorf("failed to call BPF_PROG_QUERY (BPF_CGROUP_DEVICE): %w", errno)
+		}
+		ids = ids[:attr.progCount]
+		break
+	}
+	progs := make([]*ebpf.Program, 0, len(ids))
+	for _, id := range ids {
+		prog, err := ebpf.NewProgramFromID(ebpf.ProgramID(id))
+		if err != nil {
+			if errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			for _, prog := range progs {
+				prog.Close()
+			}
+			return nil, fmt.Errorf("cannot get device filter program %d: %w", id, err)
+		}
+		progs = append(progs, prog)
+	}
+	return progs, nil
+}
+
 func isRWM(cgroupPermissions string) bool {
 	r := false
 	w := false
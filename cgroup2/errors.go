@@ -18,9 +18,54 @@ package cgroup2
 
 import (
 	"errors"
+	"fmt"
+
+	"github.com/containerd/cgroups/v3"
 )
 
 var (
-	ErrInvalidFormat    = errors.New("cgroups: parsing file with invalid format failed")
+	ErrInvalidFormat    = cgroups.ErrInvalidFormat
 	ErrInvalidGroupPath = errors.New("cgroups: invalid group path")
 )
+
+// ErrControllerUnavailable is returned when a controller can't be enabled for a
+// cgroup because it is not available in one of its ancestors. This usually means
+// that the controller was not delegated to the user: it has to be enabled in
+// the cgroup.subtree_control file of the parent of Ancestor first.
+type ErrControllerUnavailable struct {
+	Controller string
+	// Ancestor is the full path of the topmost cgroup the controller is not
+	// available in.
+	Ancestor string
+	// Err is the error returned when writing cgroup.subtree_control.
+	Err error
+}
+
+func (e *ErrControllerUnavailable) Error() string {
+	return fmt.Sprintf("cgroups: controller %q is not available in %q", e.Controller, e.Ancestor)
+}
+
+func (e *ErrControllerUnavailable) Unwrap() error {
+	return e.Err
+}
+
+// ErrControllerNotThreaded is returned when a controller that doesn't support
+// the threaded mode is used in a threaded subtree. Only the cpu, cpuset,
+// perf_event and pids controllers are threaded.
+type ErrControllerNotThreaded struct {
+	Controller string
+	// Path is the full path of the cgroup the controller is enabled in, if the
+	// controller prevents a cgroup from becoming the root of a threaded subtree.
+	Path string
+}
+
+func (e *ErrControllerNotThreaded) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("cgroups: controller %q enabled in %q is not threaded", e.Controller, e.Path)
+	}
+	return fmt.Sprintf("cgroups: controller %q is not threaded", e.Controller)
+}
+
+// Error is returned when an operation on a cgroup, or on one of its files,
+// fails, see cgroups.Error.
+type Error = cgroups.Error
@@ -0,0 +1,55 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/cgroups/v3"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestError(t *testing.T) {
+	root := t.TempDir()
+	c := &Manager{unifiedMountpoint: root, path: filepath.Join(root, "deleted")}
+
+	err := c.writeValues([]Value{{filename: "pids.max", value: int64(10)}})
+	var cgErr *Error
+	require.True(t, errors.As(err, &cgErr), "unexpected error %v", err)
+	assert.Equal(t, &Error{Op: "write", Path: c.path, File: "pids.max", Value: "10", Err: unix.ENOENT}, cgErr)
+	assert.True(t, cgroups.IsDeleted(err))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.False(t, cgroups.IsBusy(err))
+	assert.Equal(t, `cgroups: write "10" to `+filepath.Join(c.path, "pids.max")+": no such file or directory", err.Error())
+
+	err = c.writeValues([]Value{{filename: "pids.max", value: 1.5}})
+	assert.True(t, cgroups.IsInvalid(err))
+
+	_, err = c.readFile("memory.current")
+	require.True(t, errors.As(err, &cgErr), "unexpected error %v", err)
+	assert.Equal(t, "read", cgErr.Op)
+	assert.True(t, cgroups.IsDeleted(err))
+
+	assert.True(t, cgroups.IsBusy(&Error{Op: "remove", Path: c.path, Err: unix.EBUSY}))
+	assert.True(t, cgroups.IsNotSupported(&Error{Op: "write", Path: c.path, File: "memory.max", Err: unix.EOPNOTSUPP}))
+}
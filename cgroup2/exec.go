@@ -0,0 +1,85 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneIntoCgroupUnsupported is set once clone3(CLONE_INTO_CGROUP) failed with
+// ENOSYS, EOPNOTSUPP or E2BIG. It requires a 5.7+ kernel, and is not available
+// when a seccomp filter blocks clone3, as is common inside containers.
+var cloneIntoCgroupUnsupported int32
+
+// isCloneIntoCgroupUnsupported returns whether err is the error of a clone3 that
+// the kernel, or a seccomp filter, doesn't allow.
+func isCloneIntoCgroupUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.E2BIG)
+}
+
+// Start starts cmd inside the cgroup. When clone3(CLONE_INTO_CGROUP) is available
+// the process is created directly in the cgroup, so that all of its allocations
+// and children are accounted to the cgroup from the start. Otherwise the process
+// is started first and then added to the cgroup; if that fails, the process is
+// killed and the error is returned.
+//
+// Whether clone3 is available is learnt from the first command started, which
+// is started again without it if needed. The pipes created with the Pipe
+// methods of that command are closed by the failed attempt though, so the
+// error of the second attempt is returned for such commands.
+func (c *Manager) Start(cmd *exec.Cmd) error {
+	if haveUseCgroupFD && atomic.LoadInt32(&cloneIntoCgroupUnsupported) == 0 {
+		dir, err := c.open(".", os.O_RDONLY|unix.O_DIRECTORY)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+
+		// a command can only be started once, keep a copy of it to start it
+		// again without clone3
+		fallback := *cmd
+		// don't modify SysProcAttr in place, it may be shared with other commands
+		attr := &syscall.SysProcAttr{}
+		if cmd.SysProcAttr != nil {
+			*attr = *cmd.SysProcAttr
+		}
+		setCgroupFD(attr, int(dir.Fd()))
+		cmd.SysProcAttr = attr
+		err = cmd.Start()
+		if !isCloneIntoCgroupUnsupported(err) {
+			return err
+		}
+		atomic.StoreInt32(&cloneIntoCgroupUnsupported, 1)
+		*cmd = fallback
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := c.AddProc(uint64(cmd.Process.Pid)); err != nil {
+		// the process must not keep running outside of the cgroup
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestStartFallback(t *testing.T) {
+	root := fakeMountpoint(t)
+	c, err := NewManager(root, "/child", &Resources{}, withFilePerm)
+	require.NoError(t, err)
+
+	// the outcome of a clone3 that failed with ENOSYS
+	atomic.StoreInt32(&cloneIntoCgroupUnsupported, 1)
+	defer atomic.StoreInt32(&cloneIntoCgroupUnsupported, 0)
+
+	cmd := exec.Command("true")
+	require.NoError(t, c.Start(cmd))
+	require.NoError(t, cmd.Wait())
+	assert.Nil(t, cmd.SysProcAttr, "clone3 must not be used once it failed with ENOSYS")
+	checkFileContent(t, c.path, cgroupProcs, strconv.Itoa(cmd.ProcessState.Pid()))
+}
+
+func TestIsCloneIntoCgroupUnsupported(t *testing.T) {
+	for _, err := range []error{unix.ENOSYS, unix.EOPNOTSUPP, unix.E2BIG} {
+		assert.True(t, isCloneIntoCgroupUnsupported(&os.PathError{Op: "fork/exec", Path: "true", Err: err}), err)
+	}
+	assert.False(t, isCloneIntoCgroupUnsupported(unix.EAGAIN), "a pids limit must not disable clone3")
+	assert.False(t, isCloneIntoCgroupUnsupported(nil))
+}
+
+func TestStart(t *testing.T) {
+	checkCgroupMode(t)
+	group := fmt.Sprintf("/test-start-%d", os.Getpid())
+	c, err := NewManager(defaultCgroup2Path, group, &Resources{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = c.Kill()
+		_ = c.Delete()
+	})
+
+	cmd := exec.Command("sleep", "infinity")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+	require.NoError(t, c.Start(cmd))
+	go func() {
+		_ = cmd.Wait()
+	}()
+
+	path, err := PidGroupPath(cmd.Process.Pid)
+	require.NoError(t, err)
+	assert.Equal(t, group, path)
+}
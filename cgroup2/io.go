@@ -29,6 +29,19 @@ const (
 
 type BFQ struct {
 	Weight uint16
+	// WeightDevice overrides Weight for specific devices
+	WeightDevice []BFQDeviceWeight
+}
+
+// BFQDeviceWeight is the BFQ weight of a device.
+type BFQDeviceWeight struct {
+	Major  int64
+	Minor  int64
+	Weight uint16
+}
+
+func (d BFQDeviceWeight) String() string {
+	return fmt.Sprintf("%d:%d %d", d.Major, d.Minor, d.Weight)
 }
 
 type Entry struct {
@@ -54,6 +67,12 @@ func (i *IO) Values() (o []Value) {
 			value:    i.BFQ.Weight,
 		})
 	}
+	for _, d := range i.BFQ.WeightDevice {
+		o = append(o, Value{
+			filename: "io.bfq.weight",
+			value:    d.String(),
+		})
+	}
 	for _, e := range i.Max {
 		o = append(o, Value{
 			filename: "io.max",
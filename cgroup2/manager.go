@@ -22,19 +22,20 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
-	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/containerd/cgroups/v3"
 	"github.com/containerd/cgroups/v3/cgroup2/stats"
 
 	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
 	"github.com/godbus/dbus/v5"
 	"github.com/opencontainers/runtime-spec/specs-go"
-	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
@@ -45,10 +46,10 @@ const (
 	typeFile           = "cgroup.type"
 	defaultCgroup2Path = "/sys/fs/cgroup"
 	defaultSlice       = "system.slice"
+	defaultUserSlice   = "user.slice"
+	rootSlice          = "-.slice"
 )
 
-var canDelegate bool
-
 type Event struct {
 	Low     uint64
 	High    uint64
@@ -67,6 +68,9 @@ type Resources struct {
 	HugeTlb *HugeTlb
 	// When len(Devices) is zero, devices are not controlled
 	Devices []specs.LinuxDeviceCgroup
+	// Unified are raw cgroup files and their values, which are written after
+	// all the other resources. They take precedence over the other fields.
+	Unified map[string]string
 }
 
 // Values returns the raw filenames and values that
@@ -90,6 +94,17 @@ func (r *Resources) Values() (o []Value) {
 	if r.HugeTlb != nil {
 		o = append(o, r.HugeTlb.Values()...)
 	}
+	keys := make([]string, 0, len(r.Unified))
+	for k := range r.Unified {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o = append(o, Value{
+			filename: k,
+			value:    r.Unified[k],
+		})
+	}
 	return o
 }
 
@@ -116,6 +131,14 @@ func (r *Resources) EnabledControllers() (c []string) {
 	if r.HugeTlb != nil {
 		c = append(c, "hugetlb")
 	}
+	// files of the unified resources are prefixed with their controller,
+	// except for the core files
+	for k := range r.Unified {
+		controller, _, ok := strings.Cut(k, ".")
+		if ok && controller != "cgroup" && !contains(c, controller) {
+			c = append(c, controller)
+		}
+	}
 	return
 }
 
@@ -125,71 +148,135 @@ type Value struct {
 	value    interface{}
 }
 
-// write the value to the full, absolute path, of a unified hierarchy
-func (c *Value) write(path string, perm os.FileMode) error {
-	var data []byte
+// data returns the raw content to write for the value
+func (c *Value) data() ([]byte, error) {
 	switch t := c.value.(type) {
 	case uint64:
-		data = []byte(strconv.FormatUint(t, 10))
+		return []byte(strconv.FormatUint(t, 10)), nil
 	case uint16:
-		data = []byte(strconv.FormatUint(uint64(t), 10))
+		return []byte(strconv.FormatUint(uint64(t), 10)), nil
 	case int64:
-		data = []byte(strconv.FormatInt(t, 10))
+		return []byte(strconv.FormatInt(t, 10)), nil
 	case []byte:
-		data = t
+		return t, nil
 	case string:
-		data = []byte(t)
+		return []byte(t), nil
 	case CPUMax:
-		data = []byte(t)
+		return []byte(t), nil
 	default:
-		return ErrInvalidFormat
+		return nil, ErrInvalidFormat
 	}
+}
 
-	return os.WriteFile(
+// write the value to the full, absolute path, of a unified hierarchy
+func (c *Value) write(path string, perm os.FileMode) error {
+	data, err := c.data()
+	if err != nil {
+		return cgroups.NewError("write", path, c.filename, "", err)
+	}
+	if err := os.WriteFile(
 		filepath.Join(path, c.filename),
 		data,
 		perm,
-	)
+	); err != nil {
+		return cgroups.NewError("write", path, c.filename, string(data), err)
+	}
+	return nil
 }
 
-func writeValues(path string, values []Value) error {
+func writeValues(path string, perm os.FileMode, values []Value) error {
 	for _, o := range values {
-		if err := o.write(path, defaultFilePerm); err != nil {
+		if err := o.write(path, perm); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func NewManager(mountpoint string, group string, resources *Resources) (*Manager, error) {
+// NewManager creates the group below mountpoint and applies resources to it.
+// The mountpoint argument takes precedence over WithMountpoint.
+func NewManager(mountpoint string, group string, resources *Resources, opts ...InitOpts) (*Manager, error) {
 	if resources == nil {
 		return nil, errors.New("resources reference is nil")
 	}
+	c := InitConfig{mountpoint: mountpoint}
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return nil, err
+		}
+	}
 	if err := VerifyGroupPath(group); err != nil {
 		return nil, err
 	}
 	path := filepath.Join(mountpoint, group)
-	if err := os.MkdirAll(path, defaultDirPerm); err != nil {
-		return nil, err
-	}
 	m := Manager{
 		unifiedMountpoint: mountpoint,
 		path:              path,
+		logger:            c.logger,
+		fsType:            c.fsType,
+		delegateFile:      c.delegateFile,
+		filePerm:          c.filePerm,
+	}
+	if c.dirFD {
+		mnt, err := openMountpoint(mountpoint, c.fsType)
+		if err != nil {
+			return nil, err
+		}
+		m.dir, err = mkdirAllAt(mnt, relativeGroup(group))
+		mnt.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(path, defaultDirPerm); err != nil {
+		return nil, err
 	}
 	if err := m.ToggleControllers(resources.EnabledControllers(), Enable); err != nil {
 		// clean up cgroup dir on failure
-		os.Remove(path)
+		m.Close()
+		removeGroup(&c, path, group)
 		return nil, err
 	}
-	if err := setResources(path, resources); err != nil {
-		os.Remove(path)
+	if err := m.setResources(resources); err != nil {
+		m.Close()
+		removeGroup(&c, path, group)
 		return nil, err
 	}
 	return &m, nil
 }
 
+// removeGroup removes the directory of a group that couldn't be set up by
+// NewManager.
+func removeGroup(c *InitConfig, path, group string) {
+	if !c.dirFD {
+		os.Remove(path)
+		return
+	}
+	mnt, err := openMountpoint(c.mountpoint, c.fsType)
+	if err != nil {
+		return
+	}
+	defer mnt.Close()
+	_ = rmdirAt(mnt, relativeGroup(group))
+}
+
 type InitConfig struct {
 	mountpoint string
+	dirFD      bool
+	// fsType is the file system type the mountpoint must have with WithDirFD,
+	// CGROUP2_SUPER_MAGIC when 0
+	fsType int64
+	// delegateFile lists the files chowned by Delegate, kernelDelegateFile
+	// when empty
+	delegateFile string
+	// filePerm is the mode of the files created by writing a value. The
+	// kernel creates all the files of a cgroup, only the tests running on
+	// other file systems rely on the files being created.
+	filePerm   os.FileMode
+	logger     cgroups.Logger
+	systemd    systemdDialer
+	systemdBus systemdBus
+	// systemdProperties are set on the units created by NewSystemd
+	systemdProperties []systemdDbus.Property
 }
 
 type InitOpts func(c *InitConfig) error
@@ -202,6 +289,105 @@ func WithMountpoint(path string) InitOpts {
 	}
 }
 
+// WithDirFD makes the manager open the cgroup directory once, and hold on to it
+// as an O_PATH file descriptor. All the files of the cgroup are then opened
+// relative to that descriptor with openat2(2), which refuses to follow symlinks
+// or to leave the cgroup directory and the cgroup file system. This protects
+// against renames and symlinks planted by the owner of a delegated subtree.
+// On kernels without openat2 (older than 5.6), or when a seccomp filter blocks
+// it, every path component is opened with O_NOFOLLOW instead, and verified to
+// be on the cgroup file system.
+//
+// Managers created with this option must be released with Close.
+func WithDirFD() InitOpts {
+	return func(c *InitConfig) error {
+		c.dirFD = true
+		return nil
+	}
+}
+
+// WithLogger sets the logger the manager reports the problems that don't make
+// an operation fail to. Children created with NewChild inherit it. The logger
+// set with cgroups.SetLogger is used by default.
+func WithLogger(l cgroups.Logger) InitOpts {
+	return func(c *InitConfig) error {
+		c.logger = l
+		return nil
+	}
+}
+
+// WithSystemdUserBus makes the systemd managers talk to the systemd instance of
+// the user, over the session bus, instead of the system instance. The units are
+// then created in the cgroup of the user instance, by default in its
+// user.slice, which is how rootless container engines create their scopes.
+func WithSystemdUserBus() InitOpts {
+	return func(c *InitConfig) error {
+		c.systemd = func(ctx context.Context) (systemdConn, error) {
+			return systemdDbus.NewUserConnectionContext(ctx)
+		}
+		c.systemdBus = func() (*dbus.Conn, error) {
+			return privateBus(dbus.SessionBusPrivate)
+		}
+		return nil
+	}
+}
+
+// WithSystemdBus makes the systemd managers talk to the systemd instance on the
+// bus connections returned by dial, which must be authenticated, and
+// registered with Hello when there is a bus daemon. A new connection is dialed
+// for every operation, and for WatchSystemd. The units are created in the
+// cgroup of the systemd instance on that bus.
+func WithSystemdBus(dial func() (*dbus.Conn, error)) InitOpts {
+	return func(c *InitConfig) error {
+		if dial == nil {
+			return errors.New("systemd bus dialer is nil")
+		}
+		c.systemd = func(context.Context) (systemdConn, error) {
+			return systemdDbus.NewConnection(dial)
+		}
+		c.systemdBus = dial
+		return nil
+	}
+}
+
+// WithSystemdConn makes the systemd managers use conn, which is never closed by
+// the managers. The units are created in the cgroup of the systemd instance
+// conn is connected to.
+//
+// conn doesn't give access to the signals of systemd: WatchSystemd fails with
+// ErrSystemdConnWatch for these managers. Use WithSystemdBus instead for the
+// managers that watch their unit.
+func WithSystemdConn(conn *systemdDbus.Conn) InitOpts {
+	return func(c *InitConfig) error {
+		if conn == nil {
+			return errors.New("systemd connection is nil")
+		}
+		c.systemd = func(context.Context) (systemdConn, error) {
+			return sharedSystemdConn{conn}, nil
+		}
+		c.systemdBus = func() (*dbus.Conn, error) {
+			return nil, ErrSystemdConnWatch
+		}
+		return nil
+	}
+}
+
+// WithSystemdProperties sets extra properties on the units created by
+// NewSystemd, e.g. the ones returned by ParseSystemdAnnotations. They replace
+// the properties of the same name set by NewSystemd, except for Slice,
+// Delegate, PIDs and Wants, which place the unit and are rejected.
+func WithSystemdProperties(properties ...systemdDbus.Property) InitOpts {
+	return func(c *InitConfig) error {
+		for _, p := range properties {
+			if contains(systemdReservedProperties, p.Name) {
+				return fmt.Errorf("cgroups: the systemd property %s is set by NewSystemd", p.Name)
+			}
+		}
+		c.systemdProperties = append(c.systemdProperties, properties...)
+		return nil
+	}
+}
+
 // Load a cgroup.
 func Load(group string, opts ...InitOpts) (*Manager, error) {
 	c := InitConfig{mountpoint: defaultCgroup2Path}
@@ -215,39 +401,118 @@ func Load(group string, opts ...InitOpts) (*Manager, error) {
 		return nil, err
 	}
 	path := filepath.Join(c.mountpoint, group)
-	return &Manager{
+	m := &Manager{
 		unifiedMountpoint: c.mountpoint,
 		path:              path,
-	}, nil
+		logger:            c.logger,
+		systemd:           c.systemd,
+		systemdBus:        c.systemdBus,
+		fsType:            c.fsType,
+		delegateFile:      c.delegateFile,
+		filePerm:          c.filePerm,
+	}
+	if c.dirFD {
+		mnt, err := openMountpoint(c.mountpoint, c.fsType)
+		if err != nil {
+			return nil, err
+		}
+		defer mnt.Close()
+		if m.dir, err = openat(mnt, relativeGroup(group), unix.O_PATH|unix.O_DIRECTORY, 0); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
 }
 
 type Manager struct {
 	unifiedMountpoint string
 	path              string
+	// dir is the cgroup directory opened with O_PATH, see WithDirFD
+	dir *os.File
+	// fsType is the file system type of the mountpoint, see InitConfig
+	fsType int64
+	// delegateFile lists the files chowned by Delegate, see InitConfig
+	delegateFile string
+	// filePerm is the mode of the files created by writing, see InitConfig
+	filePerm os.FileMode
+	logger   cgroups.Logger
+	// systemd connects to systemd, see WithSystemdUserBus and WithSystemdConn
+	systemd systemdDialer
+	// systemdBus connects to the bus of systemd to receive its signals
+	systemdBus systemdBus
+}
+
+// log returns the logger of the manager, see WithLogger
+func (c *Manager) log() cgroups.Logger {
+	if c.logger != nil {
+		return c.logger
+	}
+	return cgroups.GetLogger()
+}
+
+// log returns the logger set with WithLogger, for the work done before the
+// manager exists
+func (c *InitConfig) log() cgroups.Logger {
+	if c.logger != nil {
+		return c.logger
+	}
+	return cgroups.GetLogger()
 }
 
-func setResources(path string, resources *Resources) error {
+func (c *Manager) setResources(resources *Resources) error {
 	if resources != nil {
-		if err := writeValues(path, resources.Values()); err != nil {
+		if err := c.checkMemoryUsage(resources.Memory); err != nil {
+			return err
+		}
+		if err := c.writeValues(resources.Values()); err != nil {
 			return err
 		}
-		if err := setDevices(path, resources.Devices); err != nil {
+		if err := c.setDevices(resources.Devices); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// checkMemoryUsage fails when the memory limit is to be lowered below the current
+// memory usage of the cgroup, and memory.CheckBeforeUpdate is set.
+func (c *Manager) checkMemoryUsage(memory *Memory) error {
+	if memory == nil || !memory.CheckBeforeUpdate || memory.Max == nil || *memory.Max == -1 {
+		return nil
+	}
+	usage, err := c.readFile("memory.current")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	current, err := strconv.ParseInt(strings.TrimSpace(string(usage)), 10, 64)
+	if err != nil {
+		return err
+	}
+	if *memory.Max < current {
+		return fmt.Errorf("cgroups: rejecting memory limit %d below the current usage %d", *memory.Max, current)
+	}
+	return nil
+}
+
 // CgroupType represents the types a cgroup can be.
 type CgroupType string
 
 const (
 	Domain   CgroupType = "domain"
 	Threaded CgroupType = "threaded"
+	// DomainThreaded is the type of a domain cgroup that is the root of a
+	// threaded subtree.
+	DomainThreaded CgroupType = "domain threaded"
+	// DomainInvalid is the type of a domain cgroup inside of a threaded subtree,
+	// which can't be used until it is made threaded.
+	DomainInvalid CgroupType = "domain invalid"
 )
 
 func (c *Manager) GetType() (CgroupType, error) {
-	val, err := os.ReadFile(filepath.Join(c.path, typeFile))
+	val, err := c.readFile(typeFile)
 	if err != nil {
 		return "", err
 	}
@@ -264,11 +529,23 @@ func (c *Manager) SetType(cgType CgroupType) error {
 		filename: typeFile,
 		value:    string(cgType),
 	}
-	return writeValues(c.path, []Value{v})
+	return c.writeValues([]Value{v})
 }
 
 func (c *Manager) RootControllers() ([]string, error) {
-	b, err := os.ReadFile(filepath.Join(c.unifiedMountpoint, controllersFile))
+	mnt, err := c.mountpointDir()
+	if err != nil {
+		return nil, err
+	}
+	if mnt != nil {
+		defer mnt.Close()
+	}
+	root, err := c.openAncestor(mnt, c.unifiedMountpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	b, err := root.readFile(controllersFile)
 	if err != nil {
 		return nil, err
 	}
@@ -276,7 +553,7 @@ func (c *Manager) RootControllers() ([]string, error) {
 }
 
 func (c *Manager) Controllers() ([]string, error) {
-	b, err := os.ReadFile(filepath.Join(c.path, controllersFile))
+	b, err := c.readFile(controllersFile)
 	if err != nil {
 		return nil, err
 	}
@@ -284,7 +561,7 @@ func (c *Manager) Controllers() ([]string, error) {
 }
 
 func (c *Manager) Update(resources *Resources) error {
-	return setResources(c.path, resources)
+	return c.setResources(resources)
 }
 
 type ControllerToggle int
@@ -302,34 +579,169 @@ func toggleFunc(controllers []string, prefix string) []string {
 	return out
 }
 
-func (c *Manager) ToggleControllers(controllers []string, t ControllerToggle) error {
+// ToggleConfig holds the settings used when toggling controllers.
+type ToggleConfig struct {
+	leaf string
+}
+
+type ToggleOpts func(c *ToggleConfig) error
+
+// WithLeafMigration works around the no internal processes rule of cgroup v2:
+// when enabling controllers fails with EBUSY because an ancestor of the cgroup
+// contains processes, the processes of that ancestor are moved into its child
+// cgroup named leaf, which is created if needed, and enabling the controllers
+// is retried. If it fails again, the processes are moved back.
+//
+// This is typically needed when nesting cgroups below the cgroup of a
+// container, which the processes of the container live in.
+func WithLeafMigration(leaf string) ToggleOpts {
+	return func(c *ToggleConfig) error {
+		if leaf == "" || strings.Contains(leaf, "/") {
+			return fmt.Errorf("invalid leaf cgroup name %q", leaf)
+		}
+		c.leaf = leaf
+		return nil
+	}
+}
+
+func (c *Manager) ToggleControllers(controllers []string, t ControllerToggle, opts ...ToggleOpts) error {
+	var conf ToggleConfig
+	for _, opt := range opts {
+		if err := opt(&conf); err != nil {
+			return err
+		}
+	}
 	// when c.path is like /foo/bar/baz, the following files need to be written:
 	// * /sys/fs/cgroup/cgroup.subtree_control
 	// * /sys/fs/cgroup/foo/cgroup.subtree_control
 	// * /sys/fs/cgroup/foo/bar/cgroup.subtree_control
 	// Note that /sys/fs/cgroup/foo/bar/baz/cgroup.subtree_control does not need to be written.
-	split := strings.Split(c.path, "/")
+	// every ancestor is opened relative to the mountpoint with WithDirFD
+	mnt, err := c.mountpointDir()
+	if err != nil {
+		return err
+	}
+	if mnt != nil {
+		defer mnt.Close()
+	}
 	var lastErr error
-	for i := range split {
-		f := strings.Join(split[:i], "/")
-		if !strings.HasPrefix(f, c.unifiedMountpoint) || f == c.path {
-			continue
+	for _, path := range c.ancestors() {
+		ancestor, err := c.openAncestor(mnt, path)
+		if err == nil {
+			err = ancestor.writeSubtreeControl(controllers, t)
+			if errors.Is(err, unix.EBUSY) && t == Enable && conf.leaf != "" {
+				err = ancestor.migrateToLeaf(conf.leaf, func() error {
+					return ancestor.writeSubtreeControl(controllers, t)
+				})
+			}
+			ancestor.Close()
 		}
-		filePath := filepath.Join(f, subtreeControl)
-		if err := c.writeSubtreeControl(filePath, controllers, t); err != nil {
+		if err != nil {
 			// When running as rootless, the user may face EPERM on parent groups, but it is negligible when the
 			// controller is already written.
 			// So we only return the last error.
-			lastErr = fmt.Errorf("failed to write subtree controllers %+v to %q: %w", controllers, filePath, err)
+			lastErr = fmt.Errorf("failed to write subtree controllers %+v to %q: %w", controllers, filepath.Join(path, subtreeControl), err)
 		} else {
 			lastErr = nil
 		}
 	}
-	return lastErr
+	return c.toggleError(mnt, controllers, t, lastErr)
+}
+
+// openAncestor returns a manager for the ancestor at path. When mnt is set, the
+// ancestor is opened relative to it.
+func (c *Manager) openAncestor(mnt *os.File, path string) (*Manager, error) {
+	m := &Manager{
+		unifiedMountpoint: c.unifiedMountpoint,
+		path:              path,
+		logger:            c.logger,
+		fsType:            c.fsType,
+		delegateFile:      c.delegateFile,
+		filePerm:          c.filePerm,
+	}
+	if mnt != nil {
+		rel, err := filepath.Rel(c.unifiedMountpoint, path)
+		if err != nil {
+			return nil, err
+		}
+		if m.dir, err = openat(mnt, rel, unix.O_PATH|unix.O_DIRECTORY, 0); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// migrateToLeaf moves the processes of the cgroup into its child named leaf and
+// calls fn. When fn fails, the processes are moved back.
+func (c *Manager) migrateToLeaf(leaf string, fn func() error) error {
+	l, err := c.NewChild(leaf, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create leaf cgroup %q: %w", filepath.Join(c.path, leaf), err)
+	}
+	defer l.Close()
+	// only the processes of the cgroup itself are moved, the ones of its
+	// descendants, e.g. other containers, stay where they are
+	procs, err := c.openProcs(false)
+	if err != nil {
+		return err
+	}
+	defer cgroups.CloseProcesses(procs)
+	moved, err := moveProcesses(procs, l)
+	if err != nil {
+		err = fmt.Errorf("failed to move processes to leaf cgroup %q: %w", l.path, err)
+	} else if err = fn(); err == nil {
+		return nil
+	}
+	if _, merr := moveProcesses(moved, c); merr != nil {
+		return fmt.Errorf("%w; moving processes back from %q failed: %v", err, l.path, merr)
+	}
+	return err
+}
+
+// toggleError returns an *ErrControllerUnavailable when enabling controllers
+// failed because one of them was not delegated to an ancestor of the cgroup.
+func (c *Manager) toggleError(mnt *os.File, controllers []string, t ControllerToggle, err error) error {
+	if err == nil || t != Enable {
+		return err
+	}
+	for _, ancestor := range c.ancestors() {
+		m, rerr := c.openAncestor(mnt, ancestor)
+		if rerr != nil {
+			continue
+		}
+		available, rerr := m.readFile(controllersFile)
+		m.Close()
+		if rerr != nil {
+			continue
+		}
+		fields := strings.Fields(string(available))
+		for _, controller := range controllers {
+			if !contains(fields, controller) {
+				return &ErrControllerUnavailable{Controller: controller, Ancestor: ancestor, Err: err}
+			}
+		}
+	}
+	return err
+}
+
+// ancestors returns the full paths of the cgroups from the root of the unified
+// hierarchy down to the parent of the cgroup.
+func (c *Manager) ancestors() []string {
+	rel, err := filepath.Rel(c.unifiedMountpoint, c.path)
+	if err != nil || rel == "." {
+		return nil
+	}
+	out := []string{c.unifiedMountpoint}
+	split := strings.Split(rel, "/")
+	for i := 1; i < len(split); i++ {
+		out = append(out, filepath.Join(c.unifiedMountpoint, filepath.Join(split[:i]...)))
+	}
+	return out
 }
 
-func (c *Manager) writeSubtreeControl(filePath string, controllers []string, t ControllerToggle) error {
-	f, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+// writeSubtreeControl toggles the controllers for the children of the cgroup.
+func (c *Manager) writeSubtreeControl(controllers []string, t ControllerToggle) error {
+	f, err := c.open(subtreeControl, os.O_WRONLY)
 	if err != nil {
 		return err
 	}
@@ -344,28 +756,42 @@ func (c *Manager) writeSubtreeControl(filePath string, controllers []string, t C
 	return err
 }
 
-func (c *Manager) NewChild(name string, resources *Resources) (*Manager, error) {
+// NewChild creates the child cgroup name and applies resources to it. The opts
+// are used when enabling the controllers needed by resources.
+func (c *Manager) NewChild(name string, resources *Resources, opts ...ToggleOpts) (*Manager, error) {
 	if strings.HasPrefix(name, "/") {
 		return nil, errors.New("name must be relative")
 	}
 	path := filepath.Join(c.path, name)
-	if err := os.MkdirAll(path, defaultDirPerm); err != nil {
-		return nil, err
-	}
 	m := Manager{
 		unifiedMountpoint: c.unifiedMountpoint,
 		path:              path,
+		logger:            c.logger,
+		fsType:            c.fsType,
+		delegateFile:      c.delegateFile,
+		filePerm:          c.filePerm,
+	}
+	if c.dir != nil {
+		dir, err := mkdirAllAt(c.dir, name)
+		if err != nil {
+			return nil, err
+		}
+		m.dir = dir
+	} else if err := os.MkdirAll(path, defaultDirPerm); err != nil {
+		return nil, err
 	}
 	if resources != nil {
-		if err := m.ToggleControllers(resources.EnabledControllers(), Enable); err != nil {
+		if err := m.ToggleControllers(resources.EnabledControllers(), Enable, opts...); err != nil {
 			// clean up cgroup dir on failure
-			os.Remove(path)
+			m.Close()
+			c.removeChild(name)
 			return nil, err
 		}
 	}
-	if err := setResources(path, resources); err != nil {
+	if err := m.setResources(resources); err != nil {
 		// clean up cgroup dir on failure
-		os.Remove(path)
+		m.Close()
+		c.removeChild(name)
 		return nil, err
 	}
 	return &m, nil
@@ -376,7 +802,7 @@ func (c *Manager) AddProc(pid uint64) error {
 		filename: cgroupProcs,
 		value:    pid,
 	}
-	return writeValues(c.path, []Value{v})
+	return c.writeValues([]Value{v})
 }
 
 func (c *Manager) AddThread(tid uint64) error {
@@ -384,7 +810,7 @@ func (c *Manager) AddThread(tid uint64) error {
 		filename: cgroupThreads,
 		value:    tid,
 	}
-	return writeValues(c.path, []Value{v})
+	return c.writeValues([]Value{v})
 }
 
 // Kill will try to forcibly exit all of the processes in the cgroup. This is
@@ -397,47 +823,95 @@ func (c *Manager) Kill() error {
 		filename: killFile,
 		value:    "1",
 	}
-	err := writeValues(c.path, []Value{v})
+	err := c.writeValues([]Value{v})
 	if err == nil {
 		return nil
 	}
-	logrus.Warnf("falling back to slower kill implementation: %s", err)
+	c.log().Warn("falling back to slower kill implementation", "error", err)
 	// Fallback to slow method.
 	return c.fallbackKill()
 }
 
 // fallbackKill is a slower fallback to the more modern (kernels 5.14+)
 // approach of writing to the cgroup.kill file. This is heavily pulled
-// from runc's same approach (in signalAllProcesses), with the only differences
-// being this is just tailored to the API exposed in this library, and we don't
-// need to care about signals other than SIGKILL.
+// from runc's same approach (in signalAllProcesses), with the only difference
+// being this is just tailored to the API exposed in this library.
 //
 // https://github.com/opencontainers/runc/blob/8da0a0b5675764feaaaaad466f6567a9983fcd08/libcontainer/init_linux.go#L523-L529
 func (c *Manager) fallbackKill() error {
-	if err := c.Freeze(); err != nil {
-		logrus.Warn(err)
+	return c.Signal(unix.SIGKILL, WithReap())
+}
+
+// SignalConfig holds the settings used when signalling the processes of a cgroup.
+type SignalConfig struct {
+	freeze bool
+	reap   bool
+}
+
+// SignalOpts configures how Signal delivers a signal.
+type SignalOpts func(c *SignalConfig) error
+
+// WithoutFreeze delivers the signal without freezing the cgroup first. Processes
+// that fork while the signal is being delivered may then escape it.
+func WithoutFreeze() SignalOpts {
+	return func(c *SignalConfig) error {
+		c.freeze = false
+		return nil
+	}
+}
+
+// WithReap waits for the signalled processes after the cgroup is thawed. Only
+// children of the calling process can be waited for, and nothing is waited for
+// when a child subreaper has been set.
+func WithReap() SignalOpts {
+	return func(c *SignalConfig) error {
+		c.reap = true
+		return nil
+	}
+}
+
+// Signal sends sig to every process in the cgroup and its descendants. By default
+// the cgroup is frozen while the processes are collected and signalled, and thawed
+// afterwards, so that a process can't fork its way out of the signal. Signals that
+// are not fatal to a frozen process are only acted upon once the cgroup is thawed.
+// A cgroup that was already frozen by the caller is left frozen.
+func (c *Manager) Signal(sig syscall.Signal, opts ...SignalOpts) error {
+	conf := SignalConfig{freeze: true}
+	for _, opt := range opts {
+		if err := opt(&conf); err != nil {
+			return err
+		}
 	}
-	pids, err := c.Procs(true)
+	if conf.freeze {
+		if state, err := c.fetchState(); err == nil && state == Frozen {
+			// there is nothing to freeze, nor to thaw afterwards
+			conf.freeze = false
+		} else if err := c.Freeze(); err != nil {
+			c.log().Warn("failed to freeze cgroup", "path", c.path, "error", err)
+		}
+	}
+	procs, err := c.openProcs(true)
 	if err != nil {
-		if err := c.Thaw(); err != nil {
-			logrus.Warn(err)
+		if conf.freeze {
+			if err := c.Thaw(); err != nil {
+				c.log().Warn("failed to thaw cgroup", "path", c.path, "error", err)
+			}
 		}
 		return err
 	}
-	var procs []*os.Process
-	for _, pid := range pids {
-		p, err := os.FindProcess(int(pid))
-		if err != nil {
-			logrus.Warn(err)
-			continue
+	defer cgroups.CloseProcesses(procs)
+	for _, p := range procs {
+		if err := p.Signal(sig); err != nil && !errors.Is(err, unix.ESRCH) {
+			c.log().Warn("failed to signal process", "pid", p.Pid(), "signal", sig, "error", err)
 		}
-		procs = append(procs, p)
-		if err := p.Signal(unix.SIGKILL); err != nil {
-			logrus.Warn(err)
+	}
+	if conf.freeze {
+		if err := c.Thaw(); err != nil {
+			c.log().Warn("failed to thaw cgroup", "path", c.path, "error", err)
 		}
 	}
-	if err := c.Thaw(); err != nil {
-		logrus.Warn(err)
+	if !conf.reap {
+		return nil
 	}
 
 	subreaper, err := getSubreaper()
@@ -457,9 +931,11 @@ func (c *Manager) fallbackKill() error {
 		// the subreaper might be waiting for this process in order
 		// to retrieve its exit code.
 		if subreaper == 0 {
-			if _, err := p.Wait(); err != nil {
+			// A child's pid can't be recycled before it is waited for,
+			// so waiting by pid is safe here.
+			if _, err := unix.Wait4(p.Pid(), nil, 0, nil); err != nil {
 				if !errors.Is(err, unix.ECHILD) {
-					logrus.Warnf("wait on pid %d failed: %s", p.Pid, err)
+					c.log().Warn("wait on pid failed", "pid", p.Pid(), "error", err)
 				}
 			}
 		}
@@ -467,6 +943,90 @@ func (c *Manager) fallbackKill() error {
 	return nil
 }
 
+// openProcs opens a handle on every process in the cgroup, and in its descendants
+// when recursive is set, backed by a pidfd on kernels 5.3 and greater so that a
+// recycled pid is never signalled or moved by mistake.
+func (c *Manager) openProcs(recursive bool) ([]*cgroups.ProcessHandle, error) {
+	list := func() ([]int, error) {
+		procs, err := c.Procs(recursive)
+		if err != nil {
+			return nil, err
+		}
+		pids := make([]int, len(procs))
+		for i, pid := range procs {
+			pids[i] = int(pid)
+		}
+		return pids, nil
+	}
+	pids, err := list()
+	if err != nil {
+		return nil, err
+	}
+	return cgroups.OpenProcesses(pids, list)
+}
+
+// Terminate gracefully stops every process in the cgroup. SIGTERM is sent to all
+// processes first; if the cgroup is still populated once grace has elapsed, the
+// remaining processes are killed with Kill. Terminate returns once the cgroup is
+// empty, or with the context's error when ctx is done before that.
+func (c *Manager) Terminate(ctx context.Context, grace time.Duration) error {
+	if err := c.Signal(unix.SIGTERM); err != nil {
+		return err
+	}
+	graceCtx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+	if err := c.waitEmpty(graceCtx); err == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.Kill(); err != nil {
+		return err
+	}
+	return c.waitEmpty(ctx)
+}
+
+// waitEmpty waits for the cgroup to no longer be populated, watching
+// cgroup.events like EventChan does.
+func (c *Manager) waitEmpty(ctx context.Context) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return errors.New("failed to create inotify fd")
+	}
+	if err := c.watchCgroupEvents(fd); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	// a non blocking fd is handled by the runtime poller, so its reads can
+	// be interrupted with a deadline
+	f := os.NewFile(uintptr(fd), "inotify")
+	defer f.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = f.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	buffer := make([]byte, unix.SizeofInotifyEvent*10)
+	for {
+		// checked after the watch is added, so that no change is missed
+		if c.isCgroupEmpty() {
+			return nil
+		}
+		if _, err := f.Read(buffer); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+}
+
 func (c *Manager) Delete() error {
 	// kernel prevents cgroups with running process from being removed, check the tree is empty
 	processes, err := c.Procs(true)
@@ -474,14 +1034,35 @@ func (c *Manager) Delete() error {
 		return err
 	}
 	if len(processes) > 0 {
-		return fmt.Errorf("cgroups: unable to remove path %q: still contains running processes", c.path)
+		return &Error{Op: "remove", Path: c.path, Err: fmt.Errorf("still contains running processes: %w", unix.EBUSY)}
+	}
+	if c.dir == nil {
+		return remove(c.path)
 	}
-	return remove(c.path)
+	parent, name, err := c.openParent()
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	return removeAt(parent, name)
 }
 
 func (c *Manager) getTasks(recursive bool, tType string) ([]uint64, error) {
 	var tasks []uint64
-	err := filepath.Walk(c.path, func(p string, info fs.FileInfo, err error) error {
+	err := c.walkTasks(recursive, tType, func(_ string, curTasks []uint64) error {
+		tasks = append(tasks, curTasks...)
+		return nil
+	})
+	return tasks, err
+}
+
+// walkTasks calls fn with the tasks listed in the tType file of the cgroup, and of
+// its descendants when recursive is set, along with the path of their cgroup.
+func (c *Manager) walkTasks(recursive bool, tType string, fn func(path string, tasks []uint64) error) error {
+	if c.dir != nil {
+		return walkTasksAt(c.dir, c.path, recursive, tType, fn)
+	}
+	return filepath.Walk(c.path, func(p string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -491,7 +1072,7 @@ func (c *Manager) getTasks(recursive bool, tType string) ([]uint64, error) {
 			}
 			return filepath.SkipDir
 		}
-		_, name := filepath.Split(p)
+		dir, name := filepath.Split(p)
 		if name != tType {
 			return nil
 		}
@@ -499,10 +1080,27 @@ func (c *Manager) getTasks(recursive bool, tType string) ([]uint64, error) {
 		if err != nil {
 			return err
 		}
-		tasks = append(tasks, curTasks...)
+		return fn(filepath.Clean(dir), curTasks)
+	})
+}
+
+func (c *Manager) getTasksInfo(recursive bool, tType string) ([]*cgroups.ProcessInfo, error) {
+	var infos []*cgroups.ProcessInfo
+	err := c.walkTasks(recursive, tType, func(path string, tasks []uint64) error {
+		for _, pid := range tasks {
+			info, err := cgroups.ReadProcessInfo(int(pid))
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return err
+			}
+			info.Path = path
+			infos = append(infos, info)
+		}
 		return nil
 	})
-	return tasks, err
+	return infos, err
 }
 
 func (c *Manager) Procs(recursive bool) ([]uint64, error) {
@@ -513,20 +1111,48 @@ func (c *Manager) Threads(recursive bool) ([]uint64, error) {
 	return c.getTasks(recursive, cgroupThreads)
 }
 
+// ProcsInfo returns the details of the processes in the cgroup, and in its
+// descendants when recursive is set, as read from /proc. Processes that exit
+// while the cgroup is scanned are left out.
+func (c *Manager) ProcsInfo(recursive bool) ([]*cgroups.ProcessInfo, error) {
+	return c.getTasksInfo(recursive, cgroupProcs)
+}
+
+// ThreadsInfo returns the details of the threads in the cgroup, and in its
+// descendants when recursive is set, as read from /proc. Threads that exit
+// while the cgroup is scanned are left out.
+func (c *Manager) ThreadsInfo(recursive bool) ([]*cgroups.ProcessInfo, error) {
+	return c.getTasksInfo(recursive, cgroupThreads)
+}
+
 func (c *Manager) MoveTo(destination *Manager) error {
-	processes, err := c.Procs(true)
+	processes, err := c.openProcs(true)
 	if err != nil {
 		return err
 	}
-	for _, p := range processes {
-		if err := destination.AddProc(p); err != nil {
-			if strings.Contains(err.Error(), "no such process") {
+	defer cgroups.CloseProcesses(processes)
+	_, err = moveProcesses(processes, destination)
+	return err
+}
+
+// moveProcesses moves procs to destination, and returns the ones that were moved.
+func moveProcesses(procs []*cgroups.ProcessHandle, destination *Manager) ([]*cgroups.ProcessHandle, error) {
+	var moved []*cgroups.ProcessHandle
+	for _, p := range procs {
+		// skip processes that exited since they were verified, their pid
+		// may already belong to another process
+		if err := p.Signal(0); err != nil {
+			continue
+		}
+		if err := destination.AddProc(uint64(p.Pid())); err != nil {
+			if errors.Is(err, unix.ESRCH) {
 				continue
 			}
-			return err
+			return moved, err
 		}
+		moved = append(moved, p)
 	}
-	return nil
+	return moved, nil
 }
 
 func (c *Manager) Stat() (*stats.Metrics, error) {
@@ -541,8 +1167,8 @@ func (c *Manager) Stat() (*stats.Metrics, error) {
 	for _, controller := range controllers {
 		switch controller {
 		case "cpu", "memory":
-			if err := readKVStatsFile(c.path, controller+".stat", out); err != nil {
-				if os.IsNotExist(err) {
+			if err := c.readKVStats(controller+".stat", out); err != nil {
+				if errors.Is(err, os.ErrNotExist) {
 					continue
 				}
 				return nil, err
@@ -550,16 +1176,16 @@ func (c *Manager) Stat() (*stats.Metrics, error) {
 		}
 	}
 	memoryEvents := make(map[string]uint64)
-	if err := readKVStatsFile(c.path, "memory.events", memoryEvents); err != nil {
-		if !os.IsNotExist(err) {
+	if err := c.readKVStats("memory.events", memoryEvents); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
 			return nil, err
 		}
 	}
 
 	var metrics stats.Metrics
 	metrics.Pids = &stats.PidsStat{
-		Current: getStatFileContentUint64(filepath.Join(c.path, "pids.current")),
-		Limit:   getStatFileContentUint64(filepath.Join(c.path, "pids.max")),
+		Current: c.statUint64("pids.current"),
+		Limit:   c.statUint64("pids.max"),
 	}
 	metrics.CPU = &stats.CPUStat{
 		UsageUsec:     out["usage_usec"],
@@ -568,7 +1194,7 @@ func (c *Manager) Stat() (*stats.Metrics, error) {
 		NrPeriods:     out["nr_periods"],
 		NrThrottled:   out["nr_throttled"],
 		ThrottledUsec: out["throttled_usec"],
-		PSI:           getStatPSIFromFile(filepath.Join(c.path, "cpu.pressure")),
+		PSI:           c.statPSI("cpu.pressure"),
 	}
 	metrics.Memory = &stats.MemoryStat{
 		Anon:                  out["anon"],
@@ -602,13 +1228,13 @@ func (c *Manager) Stat() (*stats.Metrics, error) {
 		Pglazyfreed:           out["pglazyfreed"],
 		ThpFaultAlloc:         out["thp_fault_alloc"],
 		ThpCollapseAlloc:      out["thp_collapse_alloc"],
-		Usage:                 getStatFileContentUint64(filepath.Join(c.path, "memory.current")),
-		UsageLimit:            getStatFileContentUint64(filepath.Join(c.path, "memory.max")),
-		MaxUsage:              getStatFileContentUint64(filepath.Join(c.path, "memory.peak")),
-		SwapUsage:             getStatFileContentUint64(filepath.Join(c.path, "memory.swap.current")),
-		SwapLimit:             getStatFileContentUint64(filepath.Join(c.path, "memory.swap.max")),
-		SwapMaxUsage:          getStatFileContentUint64(filepath.Join(c.path, "memory.swap.peak")),
-		PSI:                   getStatPSIFromFile(filepath.Join(c.path, "memory.pressure")),
+		Usage:                 c.statUint64("memory.current"),
+		UsageLimit:            c.statUint64("memory.max"),
+		MaxUsage:              c.statUint64("memory.peak"),
+		SwapUsage:             c.statUint64("memory.swap.current"),
+		SwapLimit:             c.statUint64("memory.swap.max"),
+		SwapMaxUsage:          c.statUint64("memory.swap.peak"),
+		PSI:                   c.statPSI("memory.pressure"),
 	}
 	if len(memoryEvents) > 0 {
 		metrics.MemoryEvents = &stats.MemoryEvents{
@@ -620,20 +1246,20 @@ func (c *Manager) Stat() (*stats.Metrics, error) {
 		}
 	}
 	metrics.Io = &stats.IOStat{
-		Usage: readIoStats(c.path),
-		PSI:   getStatPSIFromFile(filepath.Join(c.path, "io.pressure")),
+		Usage: c.ioStats(),
+		PSI:   c.statPSI("io.pressure"),
 	}
 	metrics.Rdma = &stats.RdmaStat{
-		Current: rdmaStats(filepath.Join(c.path, "rdma.current")),
-		Limit:   rdmaStats(filepath.Join(c.path, "rdma.max")),
+		Current: c.rdmaStats("rdma.current"),
+		Limit:   c.rdmaStats("rdma.max"),
 	}
-	metrics.Hugetlb = readHugeTlbStats(c.path)
+	metrics.Hugetlb = hugeTlbStats(c.statUint64)
 
 	return &metrics, nil
 }
 
-func readKVStatsFile(path string, file string, out map[string]uint64) error {
-	f, err := os.Open(filepath.Join(path, file))
+func (c *Manager) readKVStats(file string, out map[string]uint64) error {
+	f, err := c.open(file, os.O_RDONLY)
 	if err != nil {
 		return err
 	}
@@ -643,7 +1269,7 @@ func readKVStatsFile(path string, file string, out map[string]uint64) error {
 	for s.Scan() {
 		name, value, err := parseKV(s.Text())
 		if err != nil {
-			return fmt.Errorf("error while parsing %s (line=%q): %w", filepath.Join(path, file), s.Text(), err)
+			return fmt.Errorf("error while parsing %s (line=%q): %w", f.Name(), s.Text(), err)
 		}
 		out[name] = value
 	}
@@ -651,20 +1277,20 @@ func readKVStatsFile(path string, file string, out map[string]uint64) error {
 }
 
 func (c *Manager) Freeze() error {
-	return c.freeze(c.path, Frozen)
+	return c.freeze(Frozen)
 }
 
 func (c *Manager) Thaw() error {
-	return c.freeze(c.path, Thawed)
+	return c.freeze(Thawed)
 }
 
-func (c *Manager) freeze(path string, state State) error {
+func (c *Manager) freeze(state State) error {
 	values := state.Values()
 	for {
-		if err := writeValues(path, values); err != nil {
+		if err := c.writeValues(values); err != nil {
 			return err
 		}
-		current, err := fetchState(path)
+		current, err := c.fetchState()
 		if err != nil {
 			return err
 		}
@@ -678,7 +1304,7 @@ func (c *Manager) freeze(path string, state State) error {
 func (c *Manager) isCgroupEmpty() bool {
 	// In case of any error we return true so that we exit and don't leak resources
 	out := make(map[string]uint64)
-	if err := readKVStatsFile(c.path, "cgroup.events", out); err != nil {
+	if err := c.readKVStats("cgroup.events", out); err != nil {
 		return true
 	}
 	if v, ok := out["populated"]; ok {
@@ -689,26 +1315,31 @@ func (c *Manager) isCgroupEmpty() bool {
 
 // MemoryEventFD returns inotify file descriptor and 'memory.events' inotify watch descriptor
 func (c *Manager) MemoryEventFD() (int, uint32, error) {
-	fpath := filepath.Join(c.path, "memory.events")
 	fd, err := unix.InotifyInit()
 	if err != nil {
 		return 0, 0, errors.New("failed to create inotify fd")
 	}
-	wd, err := unix.InotifyAddWatch(fd, fpath, unix.IN_MODIFY)
+	wd, err := c.addWatch(fd, "memory.events")
 	if err != nil {
 		unix.Close(fd)
-		return 0, 0, fmt.Errorf("failed to add inotify watch for %q: %w", fpath, err)
+		return 0, 0, err
 	}
 	// monitor to detect process exit/cgroup deletion
-	evpath := filepath.Join(c.path, "cgroup.events")
-	if _, err = unix.InotifyAddWatch(fd, evpath, unix.IN_MODIFY); err != nil {
+	if err := c.watchCgroupEvents(fd); err != nil {
 		unix.Close(fd)
-		return 0, 0, fmt.Errorf("failed to add inotify watch for %q: %w", evpath, err)
+		return 0, 0, err
 	}
 
 	return fd, uint32(wd), nil
 }
 
+// watchCgroupEvents adds an inotify watch of cgroup.events, which is modified
+// when the cgroup gets populated or empty, to fd.
+func (c *Manager) watchCgroupEvents(fd int) error {
+	_, err := c.addWatch(fd, "cgroup.events")
+	return err
+}
+
 func (c *Manager) EventChan() (<-chan Event, <-chan error) {
 	ec := make(chan Event)
 	errCh := make(chan error, 1)
@@ -736,9 +1367,12 @@ func (c *Manager) waitForEvents(ec chan<- Event, errCh chan<- error) {
 		}
 		if bytesRead >= unix.SizeofInotifyEvent {
 			out := make(map[string]uint64)
-			if err := readKVStatsFile(c.path, "memory.events", out); err != nil {
+			if err := c.readKVStats("memory.events", out); err != nil {
 				// When cgroup is deleted read may return -ENODEV instead of -ENOENT from open.
-				if _, statErr := os.Lstat(filepath.Join(c.path, "memory.events")); !os.IsNotExist(statErr) {
+				if f, statErr := c.open("memory.events", unix.O_PATH); !errors.Is(statErr, os.ErrNotExist) {
+					if statErr == nil {
+						f.Close()
+					}
 					errCh <- err
 				}
 				return
@@ -757,7 +1391,7 @@ func (c *Manager) waitForEvents(ec chan<- Event, errCh chan<- error) {
 	}
 }
 
-func setDevices(path string, devices []specs.LinuxDeviceCgroup) error {
+func (c *Manager) setDevices(devices []specs.LinuxDeviceCgroup) error {
 	if len(devices) == 0 {
 		return nil
 	}
@@ -765,12 +1399,14 @@ func setDevices(path string, devices []specs.LinuxDeviceCgroup) error {
 	if err != nil {
 		return err
 	}
-	dirFD, err := unix.Open(path, unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0o600)
+	// BPF_PROG_ATTACH doesn't accept O_PATH descriptors
+	dir, err := c.open(".", os.O_RDONLY|unix.O_DIRECTORY)
 	if err != nil {
-		return fmt.Errorf("cannot get dir FD for %s", path)
+		return fmt.Errorf("cannot get dir FD for %s", c.path)
 	}
-	defer unix.Close(dirFD)
-	if _, err := LoadAttachCgroupDeviceFilter(insts, license, dirFD); err != nil {
+	defer dir.Close()
+	// the program attached by the previous update is replaced, not detached by the closer
+	if _, err := LoadAttachCgroupDeviceFilter(insts, license, int(dir.Fd())); err != nil {
 		if !canSkipEBPFError(devices) {
 			return err
 		}
@@ -778,45 +1414,66 @@ func setDevices(path string, devices []specs.LinuxDeviceCgroup) error {
 	return nil
 }
 
-// getSystemdFullPath returns the full systemd path when creating a systemd slice group.
-// the reason this is necessary is because the "-" character has a special meaning in
-// systemd slice. For example, when creating a slice called "my-group-112233.slice",
-// systemd will create a hierarchy like this:
+// systemdGroup returns the path, relative to the mountpoint, of the cgroup of
+// a systemd unit. This is necessary because the "-" character has a special
+// meaning in systemd slice. For example, when creating a slice called
+// "my-group-112233.slice", systemd will create a hierarchy like this:
 //
 //	/sys/fs/cgroup/my.slice/my-group.slice/my-group-112233.slice
-func getSystemdFullPath(slice, group string) string {
-	return filepath.Join(defaultCgroup2Path, dashesToPath(slice), dashesToPath(group))
-}
-
-// dashesToPath converts a slice name with dashes to it's corresponding systemd filesystem path.
-func dashesToPath(in string) string {
-	path := ""
-	if strings.HasSuffix(in, ".slice") && strings.Contains(in, "-") {
-		parts := strings.Split(in, "-")
-		for i := range parts {
-			s := strings.Join(parts[0:i+1], "-")
-			if !strings.HasSuffix(s, ".slice") {
-				s += ".slice"
-			}
-			path = filepath.Join(path, s)
+//
+// An *cgroups.InvalidUnitNameError is returned when systemd would reject the
+// names.
+func systemdGroup(slice, group string) (string, error) {
+	parent := "/"
+	if slice != "/" {
+		var err error
+		if parent, err = cgroups.ExpandSlice(slice); err != nil {
+			return "", err
 		}
-	} else {
-		path = filepath.Join(path, in)
 	}
-	return path
+	if err := cgroups.ValidateUnitName(group); err != nil {
+		return "", err
+	}
+	unit := group
+	if strings.HasSuffix(group, ".slice") {
+		var err error
+		if unit, err = cgroups.ExpandSlice(group); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(parent, unit), nil
 }
 
-func NewSystemd(slice, group string, pid int, resources *Resources) (*Manager, error) {
-	if slice == "" {
-		slice = defaultSlice
+// NewSystemd creates the systemd unit group in the parent slice, and applies
+// resources to its cgroup. The opts are used to load the cgroup, once the unit
+// is started.
+func NewSystemd(slice, group string, pid int, resources *Resources, opts ...InitOpts) (*Manager, error) {
+	c := InitConfig{}
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return nil, err
+		}
 	}
 	ctx := context.TODO()
-	path := getSystemdFullPath(slice, group)
-	conn, err := systemdDbus.NewWithContext(ctx)
+	conn, err := c.systemd.dial(ctx)
 	if err != nil {
 		return &Manager{}, err
 	}
 	defer conn.Close()
+	root, err := c.systemd.root(conn)
+	if err != nil {
+		return &Manager{}, err
+	}
+	if slice == "" {
+		slice = defaultSlice
+		if root != "" {
+			slice = defaultUserSlice
+		}
+	}
+	path, err := systemdGroup(slice, group)
+	if err != nil {
+		return &Manager{}, err
+	}
 
 	properties := []systemdDbus.Property{
 		systemdDbus.PropDescription("cgroup " + group),
@@ -826,12 +1483,20 @@ func NewSystemd(slice, group string, pid int, resources *Resources) (*Manager, e
 		newSystemdProperty("IOAccounting", true),
 	}
 
+	parent := slice
+	if parent == "/" {
+		parent = rootSlice
+	}
 	// if we create a slice, the parent is defined via a Wants=
 	if strings.HasSuffix(group, ".slice") {
-		properties = append(properties, systemdDbus.PropWants(defaultSlice))
+		properties = append(properties, systemdDbus.PropWants(parent))
 	} else {
 		// otherwise, we use Slice=
-		properties = append(properties, systemdDbus.PropSlice(defaultSlice))
+		properties = append(properties, systemdDbus.PropSlice(parent))
+		// slices can't be delegated
+		if systemdCanDelegate(conn) {
+			properties = append(properties, newSystemdProperty("Delegate", true))
+		}
 	}
 
 	// only add pid if its valid, -1 is used w/ general slice creation.
@@ -839,70 +1504,30 @@ func NewSystemd(slice, group string, pid int, resources *Resources) (*Manager, e
 		properties = append(properties, newSystemdProperty("PIDs", []uint32{uint32(pid)}))
 	}
 
-	if resources.Memory != nil && resources.Memory.Min != nil && *resources.Memory.Min != 0 {
-		properties = append(properties,
-			newSystemdProperty("MemoryMin", uint64(*resources.Memory.Min)))
-	}
-
-	if resources.Memory != nil && resources.Memory.Max != nil && *resources.Memory.Max != 0 {
-		properties = append(properties,
-			newSystemdProperty("MemoryMax", uint64(*resources.Memory.Max)))
-	}
-
-	if resources.CPU != nil {
-		// Do not add duplicate CPUWeight property
-		if resources.CPU.Idle != nil && *resources.CPU.Weight != 0 {
-			properties = append(properties,
-				newSystemdProperty("CPUWeight", uint64(0)))
-		}
-		if resources.CPU.Weight != nil && *resources.CPU.Weight != 0 {
-			properties = append(properties,
-				newSystemdProperty("CPUWeight", *resources.CPU.Weight))
-		}
-	}
-
-	if resources.CPU != nil && resources.CPU.Max != "" {
-		quota, period := resources.CPU.Max.extractQuotaAndPeriod()
-		// cpu.cfs_quota_us and cpu.cfs_period_us are controlled by systemd.
-		// corresponds to USEC_INFINITY in systemd
-		// if USEC_INFINITY is provided, CPUQuota is left unbound by systemd
-		// always setting a property value ensures we can apply a quota and remove it later
-		cpuQuotaPerSecUSec := uint64(math.MaxUint64)
-		if quota > 0 {
-			// systemd converts CPUQuotaPerSecUSec (microseconds per CPU second) to CPUQuota
-			// (integer percentage of CPU) internally.  This means that if a fractional percent of
-			// CPU is indicated by Resources.CpuQuota, we need to round up to the nearest
-			// 10ms (1% of a second) such that child cgroups can set the cpu.cfs_quota_us they expect.
-			cpuQuotaPerSecUSec = uint64(quota*1000000) / period
-			if cpuQuotaPerSecUSec%10000 != 0 {
-				cpuQuotaPerSecUSec = ((cpuQuotaPerSecUSec / 10000) + 1) * 10000
-			}
-		}
-		properties = append(properties,
-			newSystemdProperty("CPUQuotaPerSecUSec", cpuQuotaPerSecUSec))
+	resourceProperties, leftover, err := systemdProperties(resources)
+	if err != nil {
+		return &Manager{}, err
 	}
+	properties = append(properties, resourceProperties...)
+	properties = mergeSystemdProperties(properties, c.systemdProperties)
 
-	// If we can delegate, we add the property back in
-	if canDelegate {
-		properties = append(properties, newSystemdProperty("Delegate", true))
+	if err := startUnit(conn, group, properties, pid == -1, c.log()); err != nil {
+		return &Manager{}, err
 	}
 
-	if resources.Pids != nil && resources.Pids.Max > 0 {
-		properties = append(properties,
-			newSystemdProperty("TasksAccounting", true),
-			newSystemdProperty("TasksMax", uint64(resources.Pids.Max)))
+	m, err := Load(filepath.Join("/", root, path), opts...)
+	if err != nil {
+		return &Manager{}, err
 	}
-
-	if err := startUnit(conn, group, properties, pid == -1); err != nil {
+	// apply what systemd can't express to the files of the cgroup
+	if err := m.setResources(leftover); err != nil {
+		m.Close()
 		return &Manager{}, err
 	}
-
-	return &Manager{
-		path: path,
-	}, nil
+	return m, nil
 }
 
-func startUnit(conn *systemdDbus.Conn, group string, properties []systemdDbus.Property, ignoreExists bool) error {
+func startUnit(conn systemdConn, group string, properties []systemdDbus.Property, ignoreExists bool, logger cgroups.Logger) error {
 	ctx := context.TODO()
 
 	statusChan := make(chan string, 1)
@@ -925,7 +1550,7 @@ func startUnit(conn *systemdDbus.Conn, group string, properties []systemdDbus.Pr
 				retry = false
 				// When a unit of the same name already exists, it may be a leftover failed unit.
 				// If we reset it once, systemd can try to remove it.
-				attemptFailedUnitReset(conn, group)
+				attemptFailedUnitReset(conn, group, logger)
 				continue
 			}
 
@@ -938,37 +1563,59 @@ func startUnit(conn *systemdDbus.Conn, group string, properties []systemdDbus.Pr
 	select {
 	case s := <-statusChan:
 		if s != "done" {
-			attemptFailedUnitReset(conn, group)
+			attemptFailedUnitReset(conn, group, logger)
 			return fmt.Errorf("error creating systemd unit `%s`: got `%s`", group, s)
 		}
 	case <-time.After(30 * time.Second):
-		logrus.Warnf("Timed out while waiting for StartTransientUnit(%s) completion signal from dbus. Continuing...", group)
+		logger.Warn("Timed out while waiting for StartTransientUnit completion signal from dbus. Continuing...", "unit", group)
 	}
 
 	return nil
 }
 
-func attemptFailedUnitReset(conn *systemdDbus.Conn, group string) {
+func attemptFailedUnitReset(conn systemdConn, group string, logger cgroups.Logger) {
 	err := conn.ResetFailedUnitContext(context.TODO(), group)
 
 	if err != nil {
-		logrus.Warnf("Unable to reset failed unit: %v", err)
+		logger.Warn("Unable to reset failed unit", "unit", group, "error", err)
 	}
 }
 
-func LoadSystemd(slice, group string) (*Manager, error) {
+// LoadSystemd loads the cgroup of the systemd unit group in the parent slice.
+func LoadSystemd(slice, group string, opts ...InitOpts) (*Manager, error) {
+	c := InitConfig{}
+	for _, opt := range opts {
+		if err := opt(&c); err != nil {
+			return nil, err
+		}
+	}
+	var root string
+	if c.systemd != nil {
+		conn, err := c.systemd.dial(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if root, err = c.systemd.root(conn); err != nil {
+			return nil, err
+		}
+	}
 	if slice == "" {
 		slice = defaultSlice
+		if root != "" {
+			slice = defaultUserSlice
+		}
+	}
+	path, err := systemdGroup(slice, group)
+	if err != nil {
+		return nil, err
 	}
-	path := getSystemdFullPath(slice, group)
-	return &Manager{
-		path: path,
-	}, nil
+	return Load(filepath.Join("/", root, path), opts...)
 }
 
 func (c *Manager) DeleteSystemd() error {
 	ctx := context.TODO()
-	conn, err := systemdDbus.NewWithContext(ctx)
+	conn, err := c.systemd.dial(ctx)
 	if err != nil {
 		return err
 	}
@@ -983,6 +1630,97 @@ func (c *Manager) DeleteSystemd() error {
 	return nil
 }
 
+// UpdateSystemd updates the resources of a cgroup created with NewSystemd. The
+// resources systemd manages are set as runtime properties of the unit, so that
+// they survive the reload of its configuration, and the others are written to
+// the files of the cgroup.
+func (c *Manager) UpdateSystemd(ctx context.Context, resources *Resources) error {
+	if resources == nil {
+		return errors.New("resources reference is nil")
+	}
+	if err := c.checkMemoryUsage(resources.Memory); err != nil {
+		return err
+	}
+	properties, leftover, err := systemdProperties(resources)
+	if err != nil {
+		return err
+	}
+	if len(properties) > 0 {
+		conn, err := c.systemd.dial(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.SetUnitPropertiesContext(ctx, systemdUnitFromPath(c.path), true, properties...); err != nil {
+			return err
+		}
+	}
+	return c.setResources(leftover)
+}
+
+// FreezeSystemd freezes the processes of a cgroup created with NewSystemd. The
+// unit is frozen by systemd, so that it knows about the state of the unit. The
+// cgroup.freeze file is written instead when systemd can't freeze units, which
+// it does from version 246 on.
+func (c *Manager) FreezeSystemd(ctx context.Context) error {
+	return c.freezeSystemd(ctx, Frozen)
+}
+
+// ThawSystemd thaws the processes of a cgroup frozen with FreezeSystemd.
+func (c *Manager) ThawSystemd(ctx context.Context) error {
+	return c.freezeSystemd(ctx, Thawed)
+}
+
+func (c *Manager) freezeSystemd(ctx context.Context, state State) error {
+	conn, err := c.systemd.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	unit := systemdUnitFromPath(c.path)
+	if state == Frozen {
+		err = conn.FreezeUnit(ctx, unit)
+	} else {
+		err = conn.ThawUnit(ctx, unit)
+	}
+	if !isSystemdUnsupported(err) {
+		return err
+	}
+	c.log().Debug("systemd can't freeze units, writing the cgroup freezer", "unit", unit, "error", err)
+	return c.freeze(state)
+}
+
+// SystemdFreezerState returns the FreezerState property of the unit of a
+// cgroup created with NewSystemd, which is "running", "freezing", "frozen" or
+// "thawing". When systemd doesn't have the property, the state is "frozen" or
+// "running" depending on the cgroup.freeze file.
+func (c *Manager) SystemdFreezerState(ctx context.Context) (string, error) {
+	conn, err := c.systemd.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	prop, err := conn.GetUnitPropertyContext(ctx, systemdUnitFromPath(c.path), "FreezerState")
+	if err == nil {
+		state, ok := prop.Value.Value().(string)
+		if !ok {
+			return "", fmt.Errorf("unexpected FreezerState %s: %w", prop.Value, ErrInvalidFormat)
+		}
+		return state, nil
+	}
+	if !isSystemdUnsupported(err) {
+		return "", err
+	}
+	state, err := c.fetchState()
+	if err != nil {
+		return "", err
+	}
+	if state == Frozen {
+		return "frozen", nil
+	}
+	return "running", nil
+}
+
 func newSystemdProperty(name string, units interface{}) systemdDbus.Property {
 	return systemdDbus.Property{
 		Name:  name,
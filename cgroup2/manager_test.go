@@ -17,17 +17,25 @@
 package cgroup2
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/containerd/cgroups/v3"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
+	"golang.org/x/sys/unix"
 )
 
 func setupForNewSystemd(t *testing.T) (cmd *exec.Cmd, group string) {
@@ -175,8 +183,26 @@ func TestSystemdFullPath(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		actual := getSystemdFullPath(test.inputSlice, test.inputGroup)
-		assert.Equal(t, test.expectedOut, actual)
+		path, err := systemdGroup(test.inputSlice, test.inputGroup)
+		require.NoError(t, err)
+		assert.Equal(t, test.expectedOut, filepath.Join(defaultCgroup2Path, path))
+	}
+}
+
+func TestSystemdGroupInvalid(t *testing.T) {
+	for _, test := range []struct {
+		slice, group string
+	}{
+		{"user.slice", "myGroup"},
+		{"user.slice", "../myGroup.scope"},
+		{"user.slice", "my--group.slice"},
+		{"user/a.slice", "myGroup.scope"},
+		{"-user.slice", "myGroup.scope"},
+		{"user.scope", "myGroup.scope"},
+	} {
+		_, err := systemdGroup(test.slice, test.group)
+		var invalid *cgroups.InvalidUnitNameError
+		assert.ErrorAs(t, err, &invalid, "slice %q, group %q", test.slice, test.group)
 	}
 }
 
@@ -234,6 +260,71 @@ func TestKill(t *testing.T) {
 	}
 }
 
+func TestTerminate(t *testing.T) {
+	checkCgroupMode(t)
+	manager, err := NewManager(defaultCgroup2Path, "/test-terminate", ToResources(&specs.LinuxResources{}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = manager.Delete()
+	})
+
+	// sleep exits on SIGTERM, the trapping shell only goes away after Kill.
+	for _, args := range [][]string{
+		{"sleep", "infinity"},
+		{"sh", "-c", "trap '' TERM; while true; do sleep 1; done"},
+	} {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Pdeathsig: syscall.SIGKILL,
+		}
+		require.NoError(t, cmd.Start())
+		require.NoError(t, manager.AddProc(uint64(cmd.Process.Pid)))
+		go func() {
+			_ = cmd.Wait()
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = manager.Terminate(ctx, 500*time.Millisecond)
+	require.NoError(t, err)
+
+	pids, err := manager.Procs(true)
+	require.NoError(t, err)
+	assert.Empty(t, pids)
+}
+
+func TestWaitEmpty(t *testing.T) {
+	root := fakeMountpoint(t)
+	c, err := NewManager(root, "/child", &Resources{})
+	require.NoError(t, err)
+	events := filepath.Join(root, "child", "cgroup.events")
+	require.NoError(t, os.WriteFile(events, []byte("populated 1\nfrozen 0\n"), 0o644))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, c.waitEmpty(ctx), context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = os.WriteFile(events, []byte("populated 0\nfrozen 0\n"), 0o644)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, c.waitEmpty(ctx))
+}
+
+func TestSignalKeepsFreezerState(t *testing.T) {
+	root := fakeMountpoint(t)
+	c, err := NewManager(root, "/child", &Resources{})
+	require.NoError(t, err)
+	for _, state := range []string{"0", "1"} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, "child", cgroupFreeze), []byte(state), 0o644))
+		require.NoError(t, c.Signal(syscall.SIGTERM))
+		checkFileContent(t, c.path, cgroupFreeze, state)
+	}
+}
+
 func TestMoveTo(t *testing.T) {
 	checkCgroupMode(t)
 
@@ -279,6 +370,136 @@ func TestMoveTo(t *testing.T) {
 	}
 }
 
+func TestNewChildLeafMigration(t *testing.T) {
+	checkCgroupMode(t)
+	checkCgroupControllerSupported(t, "pids")
+	parent, err := NewManager(defaultCgroup2Path, "/test-leaf", ToResources(&specs.LinuxResources{}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = parent.Kill()
+		_ = os.Remove(filepath.Join(parent.path, "child"))
+		_ = os.Remove(filepath.Join(parent.path, "init"))
+		_ = parent.Delete()
+	})
+
+	cmd := exec.Command("sleep", "infinity")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+	require.NoError(t, cmd.Start())
+	go func() {
+		_ = cmd.Wait()
+	}()
+	require.NoError(t, parent.AddProc(uint64(cmd.Process.Pid)))
+
+	resources := ToResources(&specs.LinuxResources{Pids: &specs.LinuxPids{Limit: 10}})
+	_, err = parent.NewChild("child", resources)
+	require.ErrorIs(t, err, syscall.EBUSY)
+
+	child, err := parent.NewChild("child", resources, WithLeafMigration("init"))
+	require.NoError(t, err)
+	checkFileContent(t, child.path, "pids.max", "10")
+
+	procs, err := parent.Procs(false)
+	require.NoError(t, err)
+	assert.Empty(t, procs)
+	leaf, err := Load("/test-leaf/init")
+	require.NoError(t, err)
+	procs, err = leaf.Procs(false)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{uint64(cmd.Process.Pid)}, procs)
+}
+
+func TestMigrateToLeafMovesBack(t *testing.T) {
+	root := t.TempDir()
+	pid := os.Getpid()
+	require.NoError(t, os.WriteFile(filepath.Join(root, cgroupProcs), []byte(fmt.Sprintf("%d\n", pid)), 0o644))
+	c := &Manager{unifiedMountpoint: root, path: root, filePerm: testFilePerm}
+
+	err := c.migrateToLeaf("init", func() error { return syscall.EBUSY })
+	require.ErrorIs(t, err, syscall.EBUSY)
+	// the pid was written to the leaf and back to the cgroup
+	checkFileContent(t, filepath.Join(root, "init"), cgroupProcs, strconv.Itoa(pid))
+	checkFileContent(t, root, cgroupProcs, strconv.Itoa(pid))
+
+	require.NoError(t, c.migrateToLeaf("init", func() error { return nil }))
+	assert.Error(t, WithLeafMigration("a/b")(&ToggleConfig{}))
+}
+
+func TestMigrateToLeafKeepsDescendants(t *testing.T) {
+	root := t.TempDir()
+	cmd := exec.Command("sleep", "infinity")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	pid, other := os.Getpid(), cmd.Process.Pid
+	require.NoError(t, os.WriteFile(filepath.Join(root, cgroupProcs), []byte(fmt.Sprintf("%d\n", pid)), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "other-container"), defaultDirPerm))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "other-container", cgroupProcs), []byte(fmt.Sprintf("%d\n", other)), 0o644))
+	c := &Manager{unifiedMountpoint: root, path: root, filePerm: testFilePerm}
+
+	var leafProcs []byte
+	err := c.migrateToLeaf("init", func() error {
+		var err error
+		leafProcs, err = os.ReadFile(filepath.Join(root, "init", cgroupProcs))
+		require.NoError(t, err)
+		// the rollback writes the pid back, make sure it's the only one
+		require.NoError(t, os.WriteFile(filepath.Join(root, cgroupProcs), nil, 0o644))
+		return syscall.EBUSY
+	})
+	require.ErrorIs(t, err, syscall.EBUSY)
+	// only the process of the cgroup itself was moved to the leaf, and back
+	assert.Equal(t, strconv.Itoa(pid), string(leafProcs))
+	checkFileContent(t, root, cgroupProcs, strconv.Itoa(pid))
+	checkFileContent(t, filepath.Join(root, "other-container"), cgroupProcs, strconv.Itoa(other))
+}
+
+type recordingLogger struct {
+	msgs []string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) { l.msgs = append(l.msgs, msg) }
+func (l *recordingLogger) Info(msg string, args ...any)  { l.msgs = append(l.msgs, msg) }
+func (l *recordingLogger) Warn(msg string, args ...any)  { l.msgs = append(l.msgs, msg) }
+func (l *recordingLogger) Error(msg string, args ...any) { l.msgs = append(l.msgs, msg) }
+
+func TestWithLogger(t *testing.T) {
+	root := fakeMountpoint(t)
+	l := &recordingLogger{}
+	c, err := NewManager(root, "/child", &Resources{}, WithLogger(l))
+	require.NoError(t, err)
+	child, err := c.NewChild("grandchild", nil)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(child.path, "memory.current"), []byte("abc\n"), 0o644))
+
+	assert.Zero(t, child.statUint64("memory.current"))
+	assert.Equal(t, []string{"unable to parse value as a uint from cgroup file"}, l.msgs)
+}
+
+func TestProcsInfo(t *testing.T) {
+	root := t.TempDir()
+	child := filepath.Join(root, "child")
+	require.NoError(t, os.Mkdir(child, defaultDirPerm))
+	// the second pid is above any pid_max and stands for a process that exited
+	pid := os.Getpid()
+	require.NoError(t, os.WriteFile(filepath.Join(root, cgroupProcs), []byte(""), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(child, cgroupProcs), []byte(fmt.Sprintf("%d\n%d\n", pid, 1<<30)), 0o644))
+
+	c := &Manager{unifiedMountpoint: root, path: root}
+	infos, err := c.ProcsInfo(false)
+	require.NoError(t, err)
+	assert.Empty(t, infos)
+
+	infos, err = c.ProcsInfo(true)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	assert.Equal(t, pid, infos[0].Pid)
+	assert.Equal(t, child, infos[0].Path)
+	assert.Equal(t, uint32(os.Getuid()), infos[0].UID)
+}
+
 func TestCgroupType(t *testing.T) {
 	checkCgroupMode(t)
 	manager, err := NewManager(defaultCgroup2Path, "/test-type", ToResources(&specs.LinuxResources{}))
@@ -348,3 +569,97 @@ func BenchmarkStat(b *testing.B) {
 		require.NoError(b, err)
 	}
 }
+
+func TestUpdateSystemd(t *testing.T) {
+	checkCgroupMode(t)
+	cmd, group := setupForNewSystemd(t)
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+	c, err := NewSystemd("", group, cmd.Process.Pid, &Resources{Pids: &Pids{Max: 10}})
+	require.NoError(t, err, "failed to init new cgroup systemd manager")
+	t.Cleanup(func() { _ = c.DeleteSystemd() })
+	checkFileContent(t, c.path, "pids.max", "10")
+
+	require.NoError(t, c.UpdateSystemd(context.Background(), &Resources{
+		Pids:   &Pids{Max: 20},
+		Memory: &Memory{Max: int64Ptr(64 * 1024 * 1024)},
+	}))
+	checkFileContent(t, c.path, "pids.max", "20")
+	checkFileContent(t, c.path, "memory.max", strconv.Itoa(64*1024*1024))
+
+	assert.Error(t, c.UpdateSystemd(context.Background(), nil))
+}
+
+func TestUpdateDevicesReplacesFilter(t *testing.T) {
+	checkCgroupMode(t)
+	group := fmt.Sprintf("/test-devices-%d", os.Getpid())
+	devices := []specs.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}}
+	c, err := NewManager(defaultCgroup2Path, group, &Resources{Devices: devices})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = c.Delete()
+	})
+
+	devices = append(devices, specs.LinuxDeviceCgroup{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rwm"})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.Update(&Resources{Devices: devices}))
+	}
+
+	dir, err := os.Open(filepath.Join(defaultCgroup2Path, group))
+	require.NoError(t, err)
+	defer dir.Close()
+	progs, err := findAttachedCgroupDeviceFilters(int(dir.Fd()))
+	if err != nil {
+		t.Skipf("BPF_PROG_QUERY is not supported: %v", err)
+	}
+	for _, prog := range progs {
+		prog.Close()
+	}
+	assert.Len(t, progs, 1, "the device filter must be replaced on update")
+}
+
+func TestUpdateDevicesKeepsOtherFilters(t *testing.T) {
+	checkCgroupMode(t)
+	group := fmt.Sprintf("/test-devices-other-%d", os.Getpid())
+	c, err := NewManager(defaultCgroup2Path, group, &Resources{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = c.Delete()
+	})
+	dir, err := os.Open(filepath.Join(defaultCgroup2Path, group))
+	require.NoError(t, err)
+	defer dir.Close()
+
+	// a program attached by someone else, like systemd, which allows everything
+	insts, license, err := DeviceFilter(nil)
+	require.NoError(t, err)
+	other, err := ebpf.NewProgram(&ebpf.ProgramSpec{Name: "other_devices", Type: ebpf.CGroupDevice, Instructions: insts, License: license})
+	require.NoError(t, err)
+	defer other.Close()
+	require.NoError(t, link.RawAttachProgram(link.RawAttachProgramOptions{
+		Target:  int(dir.Fd()),
+		Program: other,
+		Attach:  ebpf.AttachCGroupDevice,
+		Flags:   unix.BPF_F_ALLOW_MULTI,
+	}))
+
+	devices := []specs.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.Update(&Resources{Devices: devices}))
+	}
+	progs, err := findAttachedCgroupDeviceFilters(int(dir.Fd()))
+	if err != nil {
+		t.Skipf("BPF_PROG_QUERY is not supported: %v", err)
+	}
+	defer func() {
+		for _, prog := range progs {
+			prog.Close()
+		}
+	}()
+	names := make([]string, 0, len(progs))
+	for _, prog := range progs {
+		info, err := prog.Info()
+		require.NoError(t, err)
+		names = append(names, info.Name)
+	}
+	assert.ElementsMatch(t, []string{"other_devices", deviceFilterName}, names)
+}
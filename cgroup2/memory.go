@@ -22,37 +22,49 @@ type Memory struct {
 	Max  *int64
 	Low  *int64
 	High *int64
+	// CheckBeforeUpdate makes Update fail, instead of reclaiming memory, when
+	// the new Max is lower than the current memory usage of the cgroup.
+	CheckBeforeUpdate bool
+}
+
+// memoryValue returns the value to write for a memory limit, where -1 stands
+// for no limit.
+func memoryValue(v int64) interface{} {
+	if v == -1 {
+		return "max"
+	}
+	return v
 }
 
 func (r *Memory) Values() (o []Value) {
 	if r.Swap != nil {
 		o = append(o, Value{
 			filename: "memory.swap.max",
-			value:    *r.Swap,
+			value:    memoryValue(*r.Swap),
 		})
 	}
 	if r.Min != nil {
 		o = append(o, Value{
 			filename: "memory.min",
-			value:    *r.Min,
+			value:    memoryValue(*r.Min),
 		})
 	}
 	if r.Max != nil {
 		o = append(o, Value{
 			filename: "memory.max",
-			value:    *r.Max,
+			value:    memoryValue(*r.Max),
 		})
 	}
 	if r.Low != nil {
 		o = append(o, Value{
 			filename: "memory.low",
-			value:    *r.Low,
+			value:    memoryValue(*r.Low),
 		})
 	}
 	if r.High != nil {
 		o = append(o, Value{
 			filename: "memory.high",
-			value:    *r.High,
+			value:    memoryValue(*r.High),
 		})
 	}
 	return o
@@ -17,8 +17,6 @@
 package cgroup2
 
 import (
-	"os"
-	"path/filepath"
 	"strings"
 )
 
@@ -49,8 +47,8 @@ func (s State) Values() []Value {
 	}
 }
 
-func fetchState(path string) (State, error) {
-	current, err := os.ReadFile(filepath.Join(path, cgroupFreeze))
+func (c *Manager) fetchState() (State, error) {
+	current, err := c.readFile(cgroupFreeze)
 	if err != nil {
 		return Unknown, err
 	}
@@ -0,0 +1,450 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/godbus/dbus/v5"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// systemdConn is the part of the systemd D-Bus API used by the managers, as
+// implemented by *systemdDbus.Conn
+type systemdConn interface {
+	StartTransientUnitContext(ctx context.Context, name string, mode string, properties []systemdDbus.Property, ch chan<- string) (int, error)
+	StopUnitContext(ctx context.Context, name string, mode string, ch chan<- string) (int, error)
+	ResetFailedUnitContext(ctx context.Context, name string) error
+	SetUnitPropertiesContext(ctx context.Context, name string, runtime bool, properties ...systemdDbus.Property) error
+	GetUnitPropertyContext(ctx context.Context, unit string, propertyName string) (*systemdDbus.Property, error)
+	FreezeUnit(ctx context.Context, unit string) error
+	ThawUnit(ctx context.Context, unit string) error
+	GetManagerProperty(prop string) (string, error)
+	Close()
+}
+
+// systemdDialer connects to an instance of systemd, the system instance when nil
+type systemdDialer func(ctx context.Context) (systemdConn, error)
+
+func (d systemdDialer) dial(ctx context.Context) (systemdConn, error) {
+	if d == nil {
+		return systemdDbus.NewWithContext(ctx)
+	}
+	return d(ctx)
+}
+
+// ErrSystemdConnWatch is returned by WatchSystemd for the managers using a
+// connection set with WithSystemdConn, which doesn't give access to the signals
+// of systemd. Use WithSystemdBus for the managers that watch their unit.
+var ErrSystemdConnWatch = errors.New("cgroups: the signals of systemd can't be received on a connection set with WithSystemdConn, use WithSystemdBus")
+
+// systemdBus connects to the bus of an instance of systemd, to receive its
+// signals. It connects to the system bus when nil.
+type systemdBus func() (*dbus.Conn, error)
+
+func (b systemdBus) dial() (*dbus.Conn, error) {
+	if b == nil {
+		return privateBus(dbus.SystemBusPrivate)
+	}
+	return b()
+}
+
+// privateBus opens a new connection to a message bus, and authenticates on it
+func privateBus(connect func(...dbus.ConnOption) (*dbus.Conn, error)) (*dbus.Conn, error) {
+	conn, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// root returns the cgroup of the instance of systemd conn is connected to,
+// relative to the mountpoint, e.g. "/user.slice/user-1000.slice/user@1000.service"
+// for the instance of a user. It is empty for the system instance.
+func (d systemdDialer) root(conn systemdConn) (string, error) {
+	if d == nil {
+		return "", nil
+	}
+	cgroup, err := conn.GetManagerProperty("ControlGroup")
+	if err != nil {
+		return "", err
+	}
+	cgroup = strings.Trim(cgroup, `"`)
+	if cgroup == "/" {
+		return "", nil
+	}
+	return cgroup, nil
+}
+
+// sharedSystemdConn is a connection owned by the caller, which is not closed
+type sharedSystemdConn struct {
+	*systemdDbus.Conn
+}
+
+func (sharedSystemdConn) Close() {}
+
+// systemdCanDelegate returns whether the Delegate property is supported, from
+// systemd 218 on. The version is read from conn every time, as the system and
+// user instances may differ, and so that an error only affects one unit.
+func systemdCanDelegate(conn systemdConn) bool {
+	version, err := conn.GetManagerProperty("Version")
+	if err != nil {
+		return false
+	}
+	return parseSystemdVersion(version) >= 218
+}
+
+// parseSystemdVersion returns the major version of a systemd version string,
+// like "252.4-2ubuntu1" or "v245", or 0 if it can't be parsed. The property is
+// quoted when read with GetManagerProperty.
+func parseSystemdVersion(s string) int {
+	s = strings.TrimPrefix(strings.Trim(s, `"`), "v")
+	end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if end != -1 {
+		s = s[:end]
+	}
+	version, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// isSystemdUnsupported returns whether err is the error systemd returns for
+// the methods and properties it doesn't implement, like FreezeUnit before
+// systemd 246.
+func isSystemdUnsupported(err error) bool {
+	var name string
+	var dbusErr dbus.Error
+	var dbusErrPtr *dbus.Error
+	switch {
+	case errors.As(err, &dbusErr):
+		name = dbusErr.Name
+	case errors.As(err, &dbusErrPtr):
+		name = dbusErrPtr.Name
+	default:
+		return false
+	}
+	switch name {
+	case "org.freedesktop.DBus.Error.UnknownMethod",
+		"org.freedesktop.DBus.Error.UnknownProperty",
+		"org.freedesktop.DBus.Error.NotSupported":
+		return true
+	}
+	return false
+}
+
+// procDevices lists the drivers of the character and block devices by major
+// number
+var procDevices = "/proc/devices"
+
+// systemdIODevice is the D-Bus representation, a(st), of the per-device IO
+// properties of a unit, like IODeviceWeight and IOReadBandwidthMax
+type systemdIODevice struct {
+	Path  string
+	Value uint64
+}
+
+// systemdDeviceAllow is the D-Bus representation, a(ss), of the DeviceAllow
+// property of a unit
+type systemdDeviceAllow struct {
+	Path        string
+	Permissions string
+}
+
+// systemdProperties translates resources to the properties of a systemd unit.
+// The resources that can't be expressed as properties are returned as well, to
+// be written to the cgroup files once the unit is started.
+func systemdProperties(resources *Resources) ([]systemdDbus.Property, *Resources, error) {
+	var (
+		properties []systemdDbus.Property
+		leftover   Resources
+	)
+	if mem := resources.Memory; mem != nil {
+		for _, m := range []struct {
+			name  string
+			value *int64
+		}{
+			{"MemoryMin", mem.Min},
+			{"MemoryLow", mem.Low},
+			{"MemoryHigh", mem.High},
+			{"MemoryMax", mem.Max},
+		} {
+			if m.value != nil && *m.value != 0 {
+				properties = append(properties, newSystemdProperty(m.name, systemdLimit(*m.value)))
+			}
+		}
+		if mem.Swap != nil {
+			properties = append(properties, newSystemdProperty("MemorySwapMax", systemdLimit(*mem.Swap)))
+		}
+		if mem.CheckBeforeUpdate {
+			leftover.Memory = &Memory{CheckBeforeUpdate: true}
+		}
+	}
+
+	if cpu := resources.CPU; cpu != nil {
+		switch {
+		case cpu.Idle != nil && *cpu.Idle == 1:
+			// CPUWeight=idle, which takes precedence over the weight
+			properties = append(properties, newSystemdProperty("CPUWeight", uint64(0)))
+		case cpu.Weight != nil && *cpu.Weight != 0:
+			properties = append(properties, newSystemdProperty("CPUWeight", *cpu.Weight))
+		}
+		if cpu.Max != "" {
+			max, err := ParseCPUMax(string(cpu.Max))
+			if err != nil {
+				return nil, nil, err
+			}
+			// cpu.cfs_quota_us and cpu.cfs_period_us are controlled by systemd.
+			// always setting a property value ensures we can apply a quota and remove it later.
+			// The period goes first: systemd computes the quota written to
+			// cpu.max from the period it knows when setting CPUQuotaPerSecUSec.
+			if period := max.Period(); period != defaultCPUPeriod {
+				properties = append(properties, newSystemdProperty("CPUQuotaPeriodUSec", period))
+			}
+			properties = append(properties, newSystemdProperty("CPUQuotaPerSecUSec", max.CPUQuotaPerSecUSec()))
+		}
+		for _, s := range []struct {
+			name, value string
+		}{
+			{"AllowedCPUs", cpu.Cpus},
+			{"AllowedMemoryNodes", cpu.Mems},
+		} {
+			if s.value == "" {
+				continue
+			}
+			bits, err := parseCPUSet(s.value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cgroups: invalid %s %q: %w", s.name, s.value, err)
+			}
+			properties = append(properties, newSystemdProperty(s.name, []byte(bits)))
+		}
+		// systemd has no property for the burst, and CPUWeight=idle can't
+		// reset cpu.idle to 0
+		if cpu.Burst != nil || cpu.Idle != nil {
+			leftover.CPU = &CPU{Burst: cpu.Burst, Idle: cpu.Idle}
+		}
+	}
+
+	if pids := resources.Pids; pids != nil && pids.Max != 0 {
+		properties = append(properties,
+			newSystemdProperty("TasksAccounting", true),
+			newSystemdProperty("TasksMax", systemdLimit(pids.Max)))
+	}
+
+	if io := resources.IO; io != nil {
+		if io.BFQ.Weight != 0 {
+			properties = append(properties, newSystemdProperty("IOWeight", bfqToIOWeight(io.BFQ.Weight)))
+		}
+		if len(io.BFQ.WeightDevice) > 0 {
+			weights := make([]systemdIODevice, 0, len(io.BFQ.WeightDevice))
+			for _, d := range io.BFQ.WeightDevice {
+				weights = append(weights, systemdIODevice{
+					Path:  blockDevicePath(d.Major, d.Minor),
+					Value: bfqToIOWeight(d.Weight),
+				})
+			}
+			properties = append(properties, newSystemdProperty("IODeviceWeight", weights))
+		}
+		// systemd only writes io.bfq.weight from version 252 on, and converts
+		// the weights: the exact values are written to the files
+		if io.BFQ.Weight != 0 || len(io.BFQ.WeightDevice) > 0 {
+			leftover.IO = &IO{BFQ: io.BFQ}
+		}
+		limits := make(map[IOType][]systemdIODevice)
+		for _, e := range io.Max {
+			limits[e.Type] = append(limits[e.Type], systemdIODevice{
+				Path:  blockDevicePath(e.Major, e.Minor),
+				Value: e.Rate,
+			})
+		}
+		for _, l := range []struct {
+			name string
+			t    IOType
+		}{
+			{"IOReadBandwidthMax", ReadBPS},
+			{"IOWriteBandwidthMax", WriteBPS},
+			{"IOReadIOPSMax", ReadIOPS},
+			{"IOWriteIOPSMax", WriteIOPS},
+		} {
+			if devices, ok := limits[l.t]; ok {
+				properties = append(properties, newSystemdProperty(l.name, devices))
+			}
+		}
+	}
+
+	if len(resources.Devices) > 0 {
+		deviceProperties, ok := systemdDeviceProperties(resources.Devices)
+		if ok {
+			properties = append(properties, deviceProperties...)
+		} else {
+			// the rules are enforced with our own eBPF program instead
+			leftover.Devices = resources.Devices
+		}
+	}
+
+	// systemd doesn't manage the rdma and hugetlb controllers
+	leftover.RDMA = resources.RDMA
+	leftover.HugeTlb = resources.HugeTlb
+	leftover.Unified = resources.Unified
+	return properties, &leftover, nil
+}
+
+// systemdLimit converts a limit, -1 for no limit, to its systemd value
+func systemdLimit(v int64) uint64 {
+	if v < 0 {
+		// corresponds to "infinity" in systemd
+		return math.MaxUint64
+	}
+	return uint64(v)
+}
+
+// bfqToIOWeight converts an io.bfq.weight, between 1 and 1000 with a default of
+// 100, to an IOWeight, between 1 and 10000 with the same default.
+func bfqToIOWeight(weight uint16) uint64 {
+	if weight <= 100 {
+		return uint64(weight)
+	}
+	return 100 + uint64(weight-100)*9900/900
+}
+
+func blockDevicePath(major, minor int64) string {
+	return fmt.Sprintf("/dev/block/%d:%d", major, minor)
+}
+
+// systemdDeviceProperties translates device rules to the DevicePolicy and
+// DeviceAllow properties. Only an allow list, rules that deny all the devices
+// and then allow some of them, can be expressed.
+func systemdDeviceProperties(devices []specs.LinuxDeviceCgroup) ([]systemdDbus.Property, bool) {
+	first := devices[0]
+	if first.Allow || (first.Type != "" && first.Type != "a") || !isWildcard(first.Major) || !isWildcard(first.Minor) {
+		return nil, false
+	}
+	var drivers map[string]map[int64]string
+	allow := []systemdDeviceAllow{}
+	for _, d := range devices[1:] {
+		if !d.Allow {
+			return nil, false
+		}
+		var kind string
+		switch d.Type {
+		case "c":
+			kind = "char"
+		case "b":
+			kind = "block"
+		default:
+			return nil, false
+		}
+		var path string
+		switch {
+		case isWildcard(d.Major):
+			path = kind + "-*"
+		case isWildcard(d.Minor):
+			if drivers == nil {
+				var err error
+				if drivers, err = readProcDevices(); err != nil {
+					return nil, false
+				}
+			}
+			name, ok := drivers[kind][*d.Major]
+			if !ok {
+				return nil, false
+			}
+			path = kind + "-" + name
+		default:
+			path = fmt.Sprintf("/dev/%s/%d:%d", kind, *d.Major, *d.Minor)
+		}
+		access := d.Access
+		if access == "" {
+			access = "rwm"
+		}
+		allow = append(allow, systemdDeviceAllow{Path: path, Permissions: access})
+	}
+	return []systemdDbus.Property{
+		newSystemdProperty("DevicePolicy", "strict"),
+		newSystemdProperty("DeviceAllow", allow),
+	}, true
+}
+
+func isWildcard(n *int64) bool {
+	return n == nil || *n == -1
+}
+
+// readProcDevices returns the names of the drivers by major number, for the
+// "char" and "block" devices.
+func readProcDevices() (map[string]map[int64]string, error) {
+	f, err := os.Open(procDevices)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcDevices(f)
+}
+
+func parseProcDevices(r io.Reader) (map[string]map[int64]string, error) {
+	drivers := map[string]map[int64]string{
+		"char":  {},
+		"block": {},
+	}
+	var section map[int64]string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch line {
+		case "":
+			continue
+		case "Character devices:":
+			section = drivers["char"]
+			continue
+		case "Block devices:":
+			section = drivers["block"]
+			continue
+		}
+		major, name, ok := strings.Cut(line, " ")
+		if !ok || section == nil {
+			return nil, fmt.Errorf("%s: %w", procDevices, ErrInvalidFormat)
+		}
+		n, err := strconv.ParseInt(major, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", procDevices, ErrInvalidFormat)
+		}
+		name = strings.TrimSpace(name)
+		// entries like "4 /dev/vc/0" are not driver names, and drivers sharing
+		// a major number are all allowed by the first name
+		if _, ok := section[n]; !ok && !strings.Contains(name, "/") {
+			section[n] = name
+		}
+	}
+	return drivers, s.Err()
+}
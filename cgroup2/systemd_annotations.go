@@ -0,0 +1,206 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/godbus/dbus/v5"
+)
+
+// SystemdPropertyAnnotation is the prefix of the OCI annotations that set a
+// property of the transient unit, e.g. org.systemd.property.TimeoutStopSec.
+const SystemdPropertyAnnotation = "org.systemd.property."
+
+// systemdPropertyTypes are the D-Bus types of the unit properties commonly set
+// with annotations. The values of the other properties are parsed without a
+// type, and checked by systemd.
+var systemdPropertyTypes = map[string]string{
+	"After":                         "as",
+	"AllowedCPUs":                   "ay",
+	"AllowedMemoryNodes":            "ay",
+	"Before":                        "as",
+	"CollectMode":                   "s",
+	"CPUAccounting":                 "b",
+	"CPUQuotaPerSecUSec":            "t",
+	"CPUQuotaPeriodUSec":            "t",
+	"CPUWeight":                     "t",
+	"DefaultDependencies":           "b",
+	"Description":                   "s",
+	"DevicePolicy":                  "s",
+	"IOAccounting":                  "b",
+	"IOWeight":                      "t",
+	"KillMode":                      "s",
+	"KillSignal":                    "i",
+	"ManagedOOMMemoryPressure":      "s",
+	"ManagedOOMMemoryPressureLimit": "u",
+	"ManagedOOMSwap":                "s",
+	"MemoryAccounting":              "b",
+	"MemoryHigh":                    "t",
+	"MemoryLow":                     "t",
+	"MemoryMax":                     "t",
+	"MemoryMin":                     "t",
+	"MemorySwapMax":                 "t",
+	"OOMPolicy":                     "s",
+	"Requires":                      "as",
+	"RuntimeMaxUSec":                "t",
+	"SendSIGKILL":                   "b",
+	"StartupCPUWeight":              "t",
+	"StartupIOWeight":               "t",
+	"TasksAccounting":               "b",
+	"TasksMax":                      "t",
+	"TimeoutStopUSec":               "t",
+}
+
+// systemdReservedProperties are set by NewSystemd to place the unit and its
+// processes, and can't be set with annotations or WithSystemdProperties.
+var systemdReservedProperties = []string{"Delegate", "PIDs", "Slice", "Wants"}
+
+// ParseSystemdAnnotations returns the unit properties set by the annotations
+// prefixed with SystemdPropertyAnnotation, like runc and crun do. The values are
+// in the GVariant text format, e.g. "true", "1024", "'string'" or "['a', 'b']",
+// and are parsed with the type of the property when it is known. Like with
+// systemctl, the properties ending in Sec, like TimeoutStopSec, are set in
+// microseconds to the USec property. The other annotations are ignored.
+//
+// The annotations of the properties NewSystemd sets to place the unit, Slice,
+// Delegate, PIDs and Wants, are rejected.
+func ParseSystemdAnnotations(annotations map[string]string) ([]systemdDbus.Property, error) {
+	var properties []systemdDbus.Property
+	for key, value := range annotations {
+		name := strings.TrimPrefix(key, SystemdPropertyAnnotation)
+		if name == key {
+			continue
+		}
+		invalid := func(reason string) error {
+			return &ValidationError{Field: key, Value: value, Reason: reason}
+		}
+		if !isSystemdPropertyName(name) {
+			return nil, invalid("property names are made of at least 3 ASCII letters")
+		}
+		if contains(systemdReservedProperties, name) {
+			return nil, invalid("set by NewSystemd")
+		}
+		var (
+			v   dbus.Variant
+			err error
+		)
+		if usec, ok := systemdUSecName(name); ok {
+			if v, err = dbus.ParseVariant(value, dbus.Signature{}); err != nil {
+				return nil, invalid(err.Error())
+			}
+			if v, err = secondsToUSec(v); err != nil {
+				return nil, invalid(err.Error())
+			}
+			name = usec
+		} else {
+			var sig dbus.Signature
+			if s, ok := systemdPropertyTypes[name]; ok {
+				sig = dbus.ParseSignatureMust(s)
+			}
+			if v, err = dbus.ParseVariant(value, sig); err != nil {
+				return nil, invalid(err.Error())
+			}
+		}
+		properties = append(properties, systemdDbus.Property{Name: name, Value: v})
+	}
+	// map iteration makes the order random
+	sort.Slice(properties, func(i, j int) bool { return properties[i].Name < properties[j].Name })
+	return properties, nil
+}
+
+// isSystemdPropertyName returns whether name can be a property of a unit.
+func isSystemdPropertyName(name string) bool {
+	if len(name) < 3 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// systemdUSecName returns the name of the USec property of a property in
+// seconds, e.g. TimeoutStopUSec for TimeoutStopSec.
+func systemdUSecName(name string) (string, bool) {
+	prefix := strings.TrimSuffix(name, "Sec")
+	if prefix == name || prefix == "" {
+		return "", false
+	}
+	// USec properties end with "USec", not with a lower case letter and "Sec"
+	if c := prefix[len(prefix)-1]; c < 'a' || c > 'z' {
+		return "", false
+	}
+	return prefix + "USec", true
+}
+
+// secondsToUSec converts a number of seconds to the uint64 microseconds of the
+// USec properties.
+func secondsToUSec(v dbus.Variant) (dbus.Variant, error) {
+	const usecPerSec = 1000000
+	var sec float64
+	switch n := v.Value().(type) {
+	case byte:
+		sec = float64(n)
+	case int16:
+		sec = float64(n)
+	case uint16:
+		sec = float64(n)
+	case int32:
+		sec = float64(n)
+	case uint32:
+		sec = float64(n)
+	case int64:
+		sec = float64(n)
+	case uint64:
+		sec = float64(n)
+	case float64:
+		sec = n
+	default:
+		return v, errInvalidSeconds
+	}
+	if sec < 0 {
+		return v, errInvalidSeconds
+	}
+	return dbus.MakeVariant(uint64(sec * usecPerSec)), nil
+}
+
+var errInvalidSeconds = errors.New("must be a positive number of seconds")
+
+// mergeSystemdProperties returns properties with the ones of extra, which
+// replace the properties of the same name.
+func mergeSystemdProperties(properties, extra []systemdDbus.Property) []systemdDbus.Property {
+	if len(extra) == 0 {
+		return properties
+	}
+	replaced := make(map[string]struct{}, len(extra))
+	for _, p := range extra {
+		replaced[p.Name] = struct{}{}
+	}
+	merged := make([]systemdDbus.Property, 0, len(properties)+len(extra))
+	for _, p := range properties {
+		if _, ok := replaced[p.Name]; !ok {
+			merged = append(merged, p)
+		}
+	}
+	return append(merged, extra...)
+}
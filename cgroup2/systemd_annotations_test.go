@@ -0,0 +1,102 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSystemdAnnotations(t *testing.T) {
+	properties, err := ParseSystemdAnnotations(map[string]string{
+		"org.systemd.property.CollectMode":      "'inactive-or-failed'",
+		"org.systemd.property.IOAccounting":     "true",
+		"org.systemd.property.TasksMax":         "100",
+		"org.systemd.property.TimeoutStopSec":   "1.5",
+		"org.systemd.property.RuntimeMaxUSec":   "60000000",
+		"org.systemd.property.After":            "['a.service', 'b.service']",
+		"org.systemd.property.SomethingUnknown": "uint32 7",
+		"org.opencontainers.image.title":        "ignored",
+	})
+	require.NoError(t, err)
+	names := make([]string, len(properties))
+	for i, p := range properties {
+		names[i] = p.Name
+	}
+	assert.Equal(t, []string{"After", "CollectMode", "IOAccounting", "RuntimeMaxUSec", "SomethingUnknown", "TasksMax", "TimeoutStopUSec"}, names)
+	assert.Equal(t, map[string]interface{}{
+		"After":            []string{"a.service", "b.service"},
+		"CollectMode":      "inactive-or-failed",
+		"IOAccounting":     true,
+		"RuntimeMaxUSec":   uint64(60000000),
+		"SomethingUnknown": uint32(7),
+		"TasksMax":         uint64(100),
+		"TimeoutStopUSec":  uint64(1500000),
+	}, propertyValues(properties))
+
+	for _, tc := range []struct {
+		name, value string
+	}{
+		{"Tm", "1"},
+		{"Tasks-Max", "1"},
+		{"TasksMax", "'many'"},
+		{"IOAccounting", "1"},
+		// the properties placing the unit are set by NewSystemd
+		{"Slice", "'other.slice'"},
+		{"Delegate", "false"},
+		{"PIDs", "[uint32 1]"},
+		{"Wants", "['other.slice']"},
+		{"TimeoutStopSec", "-1"},
+		{"TimeoutStopSec", "'1s'"},
+		{"Description", "unquoted"},
+		{"SomethingBroken", "["},
+	} {
+		_, err := ParseSystemdAnnotations(map[string]string{SystemdPropertyAnnotation + tc.name: tc.value})
+		var invalid *ValidationError
+		assert.ErrorAs(t, err, &invalid, "%s=%s", tc.name, tc.value)
+	}
+}
+
+func TestWithSystemdProperties(t *testing.T) {
+	s, opts := newSystemdServer(t)
+	properties, err := ParseSystemdAnnotations(map[string]string{
+		"org.systemd.property.TimeoutStopSec": "10",
+		"org.systemd.property.IOAccounting":   "false",
+	})
+	require.NoError(t, err)
+
+	_, err = NewSystemd("", "annotated.scope", -1, &Resources{}, append(opts, WithSystemdProperties(properties...))...)
+	require.NoError(t, err)
+	unit, ok := s.Unit("annotated.scope")
+	require.True(t, ok)
+	props := propertyValues(unit.Properties)
+	assert.Equal(t, uint64(10000000), props["TimeoutStopUSec"])
+	assert.Equal(t, false, props["IOAccounting"], "the annotations override the default properties")
+
+	var accounting int
+	for _, p := range unit.Properties {
+		if p.Name == "IOAccounting" {
+			accounting++
+		}
+	}
+	assert.Equal(t, 1, accounting)
+
+	_, err = NewSystemd("", "placed.scope", -1, &Resources{}, append(opts, WithSystemdProperties(newSystemdProperty("Slice", "other.slice")))...)
+	assert.Error(t, err, "the properties placing the unit can't be replaced")
+}
@@ -0,0 +1,414 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containerd/cgroups/v3/systemdtest"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func propertyValues(properties []systemdDbus.Property) map[string]interface{} {
+	values := make(map[string]interface{}, len(properties))
+	for _, p := range properties {
+		values[p.Name] = p.Value.Value()
+	}
+	return values
+}
+
+func TestSystemdProperties(t *testing.T) {
+	hugetlb := &HugeTlb{{HugePageSize: "2MB", Limit: 1 << 21}}
+	properties, leftover, err := systemdProperties(&Resources{
+		CPU: &CPU{
+			Weight: uint64Ptr(200),
+			Idle:   uint64Ptr(0),
+			Max:    "25000 50000",
+			Burst:  uint64Ptr(1000),
+			Cpus:   "0-1,9",
+			Mems:   "0",
+		},
+		Memory: &Memory{
+			Min:  int64Ptr(1024),
+			Low:  int64Ptr(2048),
+			High: int64Ptr(-1),
+			Max:  int64Ptr(4096),
+			Swap: int64Ptr(0),
+
+			CheckBeforeUpdate: true,
+		},
+		Pids: &Pids{Max: -1},
+		IO: &IO{
+			BFQ: BFQ{Weight: 1000, WeightDevice: []BFQDeviceWeight{{Major: 8, Minor: 0, Weight: 50}}},
+			Max: []Entry{
+				{Type: ReadBPS, Major: 8, Minor: 0, Rate: 1000},
+				{Type: WriteIOPS, Major: 8, Minor: 16, Rate: 10},
+			},
+		},
+		HugeTlb: hugetlb,
+		Unified: map[string]string{"memory.oom.group": "1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"CPUWeight":          uint64(200),
+		"CPUQuotaPerSecUSec": uint64(500000),
+		"CPUQuotaPeriodUSec": uint64(50000),
+		"AllowedCPUs":        []byte{0x03, 0x02},
+		"AllowedMemoryNodes": []byte{0x01},
+		"MemoryMin":          uint64(1024),
+		"MemoryLow":          uint64(2048),
+		"MemoryHigh":         uint64(math.MaxUint64),
+		"MemoryMax":          uint64(4096),
+		"MemorySwapMax":      uint64(0),
+		"TasksAccounting":    true,
+		"TasksMax":           uint64(math.MaxUint64),
+		"IOWeight":           uint64(10000),
+		"IODeviceWeight":     []systemdIODevice{{Path: "/dev/block/8:0", Value: 50}},
+		"IOReadBandwidthMax": []systemdIODevice{{Path: "/dev/block/8:0", Value: 1000}},
+		"IOWriteIOPSMax":     []systemdIODevice{{Path: "/dev/block/8:16", Value: 10}},
+	}, propertyValues(properties))
+	assert.Equal(t, &Resources{
+		CPU:     &CPU{Burst: uint64Ptr(1000), Idle: uint64Ptr(0)},
+		Memory:  &Memory{CheckBeforeUpdate: true},
+		IO:      &IO{BFQ: BFQ{Weight: 1000, WeightDevice: []BFQDeviceWeight{{Major: 8, Minor: 0, Weight: 50}}}},
+		HugeTlb: hugetlb,
+		Unified: map[string]string{"memory.oom.group": "1"},
+	}, leftover)
+
+	// systemd computes the quota from the period set before it
+	position := make(map[string]int, len(properties))
+	for i, p := range properties {
+		position[p.Name] = i
+	}
+	assert.Less(t, position["CPUQuotaPeriodUSec"], position["CPUQuotaPerSecUSec"])
+
+	// idle takes precedence over the weight, and must not need one
+	properties, _, err = systemdProperties(&Resources{CPU: &CPU{Idle: uint64Ptr(1)}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"CPUWeight": uint64(0)}, propertyValues(properties))
+
+	_, _, err = systemdProperties(&Resources{CPU: &CPU{Max: "abc"}})
+	assert.Error(t, err)
+	_, _, err = systemdProperties(&Resources{CPU: &CPU{Cpus: "0-2000000000"}})
+	assert.Error(t, err)
+}
+
+func TestBFQToIOWeight(t *testing.T) {
+	for bfq, weight := range map[uint16]uint64{1: 1, 100: 100, 550: 5050, 1000: 10000} {
+		assert.Equal(t, weight, bfqToIOWeight(bfq), "%d", bfq)
+	}
+}
+
+func TestSystemdDeviceProperties(t *testing.T) {
+	procDevices = filepath.Join(t.TempDir(), "devices")
+	t.Cleanup(func() { procDevices = "/proc/devices" })
+	require.NoError(t, os.WriteFile(procDevices, []byte(strings.Join([]string{
+		"Character devices:",
+		"  1 mem",
+		"  4 /dev/vc/0",
+		"  4 tty",
+		"136 pts",
+		"",
+		"Block devices:",
+		"  8 sd",
+	}, "\n")), 0o644))
+
+	denyAll := specs.LinuxDeviceCgroup{Allow: false, Access: "rwm"}
+	properties, ok := systemdDeviceProperties([]specs.LinuxDeviceCgroup{
+		denyAll,
+		{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rwm"},
+		{Allow: true, Type: "c", Major: int64Ptr(136), Minor: int64Ptr(-1), Access: "rw"},
+		{Allow: true, Type: "b", Major: int64Ptr(8)},
+		{Allow: true, Type: "c", Access: "m"},
+	})
+	require.True(t, ok)
+	assert.Equal(t, map[string]interface{}{
+		"DevicePolicy": "strict",
+		"DeviceAllow": []systemdDeviceAllow{
+			{Path: "/dev/char/1:3", Permissions: "rwm"},
+			{Path: "char-pts", Permissions: "rw"},
+			{Path: "block-sd", Permissions: "rwm"},
+			{Path: "char-*", Permissions: "m"},
+		},
+	}, propertyValues(properties))
+
+	for _, devices := range [][]specs.LinuxDeviceCgroup{
+		// deny list
+		{{Allow: true, Access: "rwm"}, {Allow: false, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3)}},
+		// deny after the allow list
+		{denyAll, {Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3)}, {Allow: false, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3)}},
+		// unknown driver
+		{denyAll, {Allow: true, Type: "c", Major: int64Ptr(240)}},
+	} {
+		_, ok := systemdDeviceProperties(devices)
+		assert.False(t, ok, "%+v", devices)
+	}
+
+	_, leftover, err := systemdProperties(&Resources{Devices: []specs.LinuxDeviceCgroup{{Allow: true, Access: "rwm"}}})
+	require.NoError(t, err)
+	assert.Len(t, leftover.Devices, 1, "inexpressible rules must be applied with eBPF")
+}
+
+func TestParseProcDevices(t *testing.T) {
+	drivers, err := parseProcDevices(strings.NewReader("Character devices:\n  4 /dev/vc/0\n  4 tty\n\nBlock devices:\n259 blkext\n"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[int64]string{
+		"char":  {4: "tty"},
+		"block": {259: "blkext"},
+	}, drivers)
+
+	_, err = parseProcDevices(strings.NewReader("  4 tty\n"))
+	assert.ErrorIs(t, err, ErrInvalidFormat)
+}
+
+func TestNewSystemdUserInstance(t *testing.T) {
+	controlGroup := "/user.slice/user-1000.slice/user@1000.service"
+	s, opts := newSystemdServer(t, systemdtest.WithControlGroup(controlGroup))
+
+	m, err := NewSystemd("", "podman-1.scope", -1, &Resources{}, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(s.Mountpoint(), controlGroup, "user.slice/podman-1.scope"), m.path)
+	assert.DirExists(t, m.path)
+	unit, ok := s.Unit("podman-1.scope")
+	require.True(t, ok)
+	assert.Equal(t, defaultUserSlice, propertyValues(unit.Properties)["Slice"])
+
+	loaded, err := LoadSystemd("", "podman-1.scope", opts...)
+	require.NoError(t, err)
+	assert.Equal(t, m.path, loaded.path)
+
+	// the managers keep talking to the user instance
+	require.NoError(t, loaded.DeleteSystemd())
+	_, ok = s.Unit("podman-1.scope")
+	assert.False(t, ok)
+
+	// the system instance reports the root cgroup
+	system, systemOpts := newSystemdServer(t)
+	loaded, err = LoadSystemd("", "podman-1.scope", systemOpts...)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(system.Mountpoint(), "system.slice/podman-1.scope"), loaded.path)
+
+	assert.Error(t, WithSystemdConn(nil)(&InitConfig{}))
+	assert.Error(t, WithSystemdBus(nil)(&InitConfig{}))
+}
+
+func TestFreezeSystemd(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		version string
+		// byCgroup is whether cgroup.freeze is written instead of calling
+		// FreezeUnit
+		byCgroup bool
+	}{
+		{"252", false},
+		{"245", true},
+	} {
+		s, opts := newSystemdServer(t, systemdtest.WithVersion(tc.version))
+		m, err := NewSystemd("", "frozen.scope", -1, &Resources{}, opts...)
+		require.NoError(t, err)
+		freezeFile := filepath.Join(m.path, cgroupFreeze)
+
+		require.NoError(t, m.FreezeSystemd(ctx), tc.version)
+		state, err := m.SystemdFreezerState(ctx)
+		require.NoError(t, err, tc.version)
+		assert.Equal(t, "frozen", state, tc.version)
+		if tc.byCgroup {
+			checkFileContent(t, m.path, cgroupFreeze, "1")
+		} else {
+			assert.NoFileExists(t, freezeFile, tc.version)
+			unit, _ := s.Unit("frozen.scope")
+			assert.Equal(t, "frozen", unit.FreezerState, tc.version)
+		}
+
+		require.NoError(t, m.ThawSystemd(ctx), tc.version)
+		state, err = m.SystemdFreezerState(ctx)
+		require.NoError(t, err, tc.version)
+		assert.Equal(t, "running", state, tc.version)
+		if tc.byCgroup {
+			checkFileContent(t, m.path, cgroupFreeze, "0")
+		}
+		assert.Equal(t, []string{
+			"StartTransientUnit frozen.scope",
+			"FreezeUnit frozen.scope",
+			"ThawUnit frozen.scope",
+		}, systemdMethods(s.Calls()), tc.version)
+	}
+}
+
+func TestParseSystemdVersion(t *testing.T) {
+	for s, version := range map[string]int{
+		`"252.4-2ubuntu1"`: 252,
+		`"v245"`:           245,
+		"218":              218,
+		`""`:               0,
+		"abc":              0,
+	} {
+		assert.Equal(t, version, parseSystemdVersion(s), s)
+	}
+}
+
+func newSystemdServer(t *testing.T, opts ...systemdtest.Opts) (*systemdtest.Server, []InitOpts) {
+	s := systemdtest.New(fakeMountpoint(t), opts...)
+	t.Cleanup(s.Close)
+	conn, err := s.Conn()
+	require.NoError(t, err)
+	t.Cleanup(conn.Close)
+	return s, []InitOpts{WithMountpoint(s.Mountpoint()), WithSystemdConn(conn), withFilePerm}
+}
+
+func systemdMethods(calls []systemdtest.Call) []string {
+	methods := make([]string, len(calls))
+	for i, c := range calls {
+		methods[i] = c.Method + " " + c.Unit
+	}
+	return methods
+}
+
+func TestNewSystemdServer(t *testing.T) {
+	s, opts := newSystemdServer(t, systemdtest.WithVersion("252.4-2ubuntu1"))
+	require.NoError(t, os.WriteFile(filepath.Join(s.Mountpoint(), controllersFile), []byte("cpu memory pids\n"), 0o644))
+
+	m, err := NewSystemd("test-waldo.slice", "server.scope", 1, &Resources{Pids: &Pids{Max: 10}}, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(s.Mountpoint(), "test.slice/test-waldo.slice/server.scope"), m.path)
+	assert.Equal(t, s.Mountpoint(), m.unifiedMountpoint)
+	assert.DirExists(t, m.path)
+	controllers, err := m.RootControllers()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cpu", "memory", "pids"}, controllers)
+	unit, ok := s.Unit("server.scope")
+	require.True(t, ok)
+	props := propertyValues(unit.Properties)
+	assert.Equal(t, "test-waldo.slice", props["Slice"])
+	assert.Equal(t, true, props["Delegate"])
+	assert.Equal(t, []uint32{1}, props["PIDs"])
+	assert.Equal(t, uint64(10), props["TasksMax"])
+
+	loaded, err := LoadSystemd("test-waldo.slice", "server.scope", opts...)
+	require.NoError(t, err)
+	assert.Equal(t, m.path, loaded.path)
+	assert.Equal(t, s.Mountpoint(), loaded.unifiedMountpoint)
+
+	require.NoError(t, m.UpdateSystemd(context.Background(), &Resources{Pids: &Pids{Max: 20}}))
+	unit, _ = s.Unit("server.scope")
+	assert.Equal(t, uint64(20), propertyValues(unit.Properties)["TasksMax"])
+
+	require.NoError(t, m.DeleteSystemd())
+	_, ok = s.Unit("server.scope")
+	assert.False(t, ok)
+	assert.NoDirExists(t, m.path)
+	assert.Equal(t, []string{
+		"StartTransientUnit server.scope",
+		"SetUnitProperties server.scope",
+		"StopUnit server.scope",
+	}, systemdMethods(s.Calls()))
+}
+
+func TestNewSystemdServerSlice(t *testing.T) {
+	s, opts := newSystemdServer(t)
+
+	// slices are created with Wants=, and are never delegated
+	_, err := NewSystemd("/", "my-group.slice", -1, &Resources{}, opts...)
+	require.NoError(t, err)
+	unit, ok := s.Unit("my-group.slice")
+	require.True(t, ok)
+	props := propertyValues(unit.Properties)
+	assert.Equal(t, []string{rootSlice}, props["Wants"])
+	assert.NotContains(t, props, "Slice")
+	assert.NotContains(t, props, "Delegate")
+	assert.DirExists(t, filepath.Join(s.Mountpoint(), "my.slice/my-group.slice"))
+}
+
+func TestNewSystemdServerResetFailed(t *testing.T) {
+	s, opts := newSystemdServer(t)
+	_, err := NewSystemd("", "leftover.scope", 1, &Resources{}, opts...)
+	require.NoError(t, err)
+
+	// a unit of the same name is an error, unless it failed and can be reset
+	_, err = NewSystemd("", "leftover.scope", 1, &Resources{}, opts...)
+	assert.True(t, isUnitExists(err), err)
+	require.NoError(t, s.Fail("leftover.scope"))
+	_, err = NewSystemd("", "leftover.scope", 1, &Resources{}, opts...)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"StartTransientUnit leftover.scope",
+		"StartTransientUnit leftover.scope",
+		"ResetFailedUnit leftover.scope",
+		"StartTransientUnit leftover.scope",
+		"StartTransientUnit leftover.scope",
+		"ResetFailedUnit leftover.scope",
+		"StartTransientUnit leftover.scope",
+	}, systemdMethods(s.Calls()))
+
+	// slices are created once, with a pid of -1
+	_, err = NewSystemd("/", "existing.slice", -1, &Resources{}, opts...)
+	require.NoError(t, err)
+	_, err = NewSystemd("/", "existing.slice", -1, &Resources{}, opts...)
+	require.NoError(t, err)
+}
+
+func TestNewSystemdServerJobFailed(t *testing.T) {
+	s, opts := newSystemdServer(t)
+	s.SetJobResult("broken.scope", "failed")
+	_, err := NewSystemd("", "broken.scope", 1, &Resources{}, opts...)
+	assert.ErrorContains(t, err, "got `failed`")
+	_, ok := s.Unit("broken.scope")
+	assert.False(t, ok, "the failed unit must be reset")
+}
+
+func TestSystemdCanDelegate(t *testing.T) {
+	s, opts := newSystemdServer(t, systemdtest.WithVersion("252"))
+	old, oldOpts := newSystemdServer(t, systemdtest.WithVersion("217"))
+
+	// the version is read from each instance, not once for the process
+	for i := 0; i < 2; i++ {
+		unit := fmt.Sprintf("delegate-%d.scope", i)
+		_, err := NewSystemd("", unit, -1, &Resources{}, opts...)
+		require.NoError(t, err)
+		_, err = NewSystemd("", unit, -1, &Resources{}, oldOpts...)
+		require.NoError(t, err)
+
+		u, ok := s.Unit(unit)
+		require.True(t, ok)
+		assert.Equal(t, true, propertyValues(u.Properties)["Delegate"])
+		u, ok = old.Unit(unit)
+		require.True(t, ok)
+		assert.Equal(t, defaultSlice, propertyValues(u.Properties)["Slice"])
+		assert.NotContains(t, propertyValues(u.Properties), "Delegate")
+	}
+}
+
+func TestAttemptFailedUnitResetLogger(t *testing.T) {
+	s, _ := newSystemdServer(t)
+	conn, err := s.Conn()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	l := &recordingLogger{}
+	attemptFailedUnitReset(conn, "missing.scope", l)
+	assert.Equal(t, []string{"Unable to reset failed unit"}, l.msgs)
+}
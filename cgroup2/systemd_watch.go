@@ -0,0 +1,179 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"context"
+	"errors"
+
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	systemdBusName                          = "org.freedesktop.systemd1"
+	systemdObjectPath       dbus.ObjectPath = "/org/freedesktop/systemd1"
+	systemdManagerInterface                 = "org.freedesktop.systemd1.Manager"
+	systemdUnitInterface                    = "org.freedesktop.systemd1.Unit"
+	propertiesInterface                     = "org.freedesktop.DBus.Properties"
+)
+
+// SystemdEvent is a change of the unit of a cgroup created with NewSystemd.
+type SystemdEvent struct {
+	// Unit is the name of the unit.
+	Unit string
+	// ActiveState and SubState are the new state of the unit, like "active"
+	// and "running", when systemd reports that either of them changed.
+	ActiveState string
+	SubState    string
+	// JobID and JobResult identify a job of the unit that completed, and its
+	// result, like "done", "failed" or "canceled".
+	JobID     uint32
+	JobResult string
+	// Removed is set when systemd unloaded the unit, e.g. when it garbage
+	// collected a scope whose processes all exited.
+	Removed bool
+}
+
+// WatchSystemd streams the changes of the unit of a cgroup created with
+// NewSystemd: the changes of its ActiveState and SubState, the results of its
+// jobs, and its removal. This is how to learn that systemd stopped the unit, or
+// garbage collected it. The signals are received on a new connection to the bus
+// of systemd, see WithSystemdBus, which is why the managers using a connection
+// set with WithSystemdConn can't watch their unit: ErrSystemdConnWatch is sent
+// on the error channel right away. The events are sent until ctx is done or the
+// connection to the bus fails, then both channels are closed.
+func (c *Manager) WatchSystemd(ctx context.Context) (<-chan SystemdEvent, <-chan error) {
+	ec := make(chan SystemdEvent)
+	errCh := make(chan error, 1)
+	go c.watchSystemd(ctx, ec, errCh)
+
+	return ec, errCh
+}
+
+func (c *Manager) watchSystemd(ctx context.Context, ec chan<- SystemdEvent, errCh chan<- error) {
+	defer close(errCh)
+	defer close(ec)
+
+	bus, err := c.systemdBus.dial()
+	if err != nil {
+		errCh <- err
+		return
+	}
+	defer bus.Close()
+
+	unit := systemdUnitFromPath(c.path)
+	ch := make(chan *dbus.Signal, 64)
+	bus.Signal(ch)
+	for _, rule := range [][]dbus.MatchOption{
+		{
+			dbus.WithMatchObjectPath(systemdUnitPath(unit)),
+			dbus.WithMatchInterface(propertiesInterface),
+			dbus.WithMatchMember("PropertiesChanged"),
+		},
+		{
+			dbus.WithMatchObjectPath(systemdObjectPath),
+			dbus.WithMatchInterface(systemdManagerInterface),
+			dbus.WithMatchMember("JobRemoved"),
+		},
+		{
+			dbus.WithMatchObjectPath(systemdObjectPath),
+			dbus.WithMatchInterface(systemdManagerInterface),
+			dbus.WithMatchMember("UnitRemoved"),
+		},
+	} {
+		if err := bus.AddMatchSignal(rule...); err != nil {
+			errCh <- err
+			return
+		}
+	}
+	// systemd only sends the signals of the units once a client subscribed
+	if err := bus.Object(systemdBusName, systemdObjectPath).CallWithContext(ctx, systemdManagerInterface+".Subscribe", 0).Err; err != nil {
+		errCh <- err
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case signal, ok := <-ch:
+			if !ok {
+				errCh <- errors.New("cgroups: connection to systemd closed")
+				return
+			}
+			event, ok := systemdEventFromSignal(unit, signal)
+			if !ok {
+				continue
+			}
+			select {
+			case ec <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// systemdEventFromSignal returns the change of unit reported by a signal, if
+// the signal is about unit.
+func systemdEventFromSignal(unit string, signal *dbus.Signal) (SystemdEvent, bool) {
+	event := SystemdEvent{Unit: unit}
+	switch signal.Name {
+	case propertiesInterface + ".PropertiesChanged":
+		var (
+			iface       string
+			changed     map[string]dbus.Variant
+			invalidated []string
+		)
+		// the signals of the other units are delivered too when the bus is
+		// shared with another subscriber
+		if signal.Path != systemdUnitPath(unit) {
+			return event, false
+		}
+		if err := dbus.Store(signal.Body, &iface, &changed, &invalidated); err != nil || iface != systemdUnitInterface {
+			return event, false
+		}
+		event.ActiveState, _ = changed["ActiveState"].Value().(string)
+		event.SubState, _ = changed["SubState"].Value().(string)
+		return event, event.ActiveState != "" || event.SubState != ""
+	case systemdManagerInterface + ".JobRemoved":
+		var (
+			job  dbus.ObjectPath
+			name string
+		)
+		if err := dbus.Store(signal.Body, &event.JobID, &job, &name, &event.JobResult); err != nil || name != unit {
+			return event, false
+		}
+		return event, true
+	case systemdManagerInterface + ".UnitRemoved":
+		var (
+			name string
+			path dbus.ObjectPath
+		)
+		if err := dbus.Store(signal.Body, &name, &path); err != nil || name != unit {
+			return event, false
+		}
+		event.Removed = true
+		return event, true
+	}
+	return event, false
+}
+
+// systemdUnitPath returns the D-Bus object of a unit.
+func systemdUnitPath(unit string) dbus.ObjectPath {
+	return systemdObjectPath + "/unit/" + dbus.ObjectPath(systemdDbus.PathBusEscape(unit))
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/containerd/cgroups/v3/systemdtest"
+	"github.com/godbus/dbus/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchSystemd(t *testing.T) {
+	s := systemdtest.New(fakeMountpoint(t))
+	t.Cleanup(s.Close)
+	opts := []InitOpts{WithMountpoint(s.Mountpoint()), WithSystemdBus(s.Dial)}
+	m, err := NewSystemd("", "watched.scope", -1, &Resources{}, opts...)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, errCh := m.WatchSystemd(ctx)
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"StartTransientUnit watched.scope", "Subscribe "}, systemdMethods(s.Calls()))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the changes of the other units are ignored
+	_, err = NewSystemd("", "other.scope", -1, &Resources{}, opts...)
+	require.NoError(t, err)
+	require.NoError(t, m.DeleteSystemd())
+	assert.Equal(t, SystemdEvent{Unit: "watched.scope", ActiveState: "inactive", SubState: "dead"}, <-events)
+	assert.Equal(t, SystemdEvent{Unit: "watched.scope", Removed: true}, <-events)
+	assert.Equal(t, SystemdEvent{Unit: "watched.scope", JobID: 3, JobResult: "done"}, <-events)
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok, "the event channel must be closed")
+	_, ok = <-errCh
+	assert.False(t, ok, "the error channel must be closed")
+}
+
+func TestWatchSystemdConn(t *testing.T) {
+	_, opts := newSystemdServer(t)
+	m, err := NewSystemd("", "watched.scope", -1, &Resources{}, opts...)
+	require.NoError(t, err)
+
+	events, errCh := m.WatchSystemd(context.Background())
+	assert.ErrorIs(t, <-errCh, ErrSystemdConnWatch)
+	_, ok := <-events
+	assert.False(t, ok, "the event channel must be closed")
+}
+
+func TestSystemdUnitPath(t *testing.T) {
+	assert.Equal(t, dbus.ObjectPath("/org/freedesktop/systemd1/unit/my_2dcontainer_2escope"), systemdUnitPath("my-container.scope"))
+	assert.Equal(t, dbus.ObjectPath("/org/freedesktop/systemd1/unit/user_401000_2eservice"), systemdUnitPath("user@1000.service"))
+	assert.Equal(t, dbus.ObjectPath("/org/freedesktop/systemd1/unit/_31_2escope"), systemdUnitPath("1.scope"))
+}
@@ -27,6 +27,17 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// testFilePerm is the mode of the files the managers create when the tests
+// run on a file system other than cgroupfs, where the kernel creates them.
+const testFilePerm = 0o644
+
+// withFilePerm makes the managers create the files they write with
+// testFilePerm.
+func withFilePerm(c *InitConfig) error {
+	c.filePerm = testFilePerm
+	return nil
+}
+
 func checkCgroupMode(tb testing.TB) {
 	var st unix.Statfs_t
 	err := unix.Statfs(defaultCgroup2Path, &st)
@@ -0,0 +1,140 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// threadedControllers are the controllers that support the threaded mode
+var threadedControllers = map[string]struct{}{
+	"cpu":        {},
+	"cpuset":     {},
+	"perf_event": {},
+	"pids":       {},
+}
+
+// NewThreadedChild creates the threaded child cgroup name and applies resources
+// to it. When the cgroup is a domain cgroup, it becomes the root of a threaded
+// subtree: its type turns into DomainThreaded, and its other domain children
+// become DomainInvalid.
+//
+// The constraints of threaded subtrees are checked before the child is created:
+// resources may only use threaded controllers, and a domain cgroup can't become
+// the root of a threaded subtree while a domain controller is enabled in its
+// cgroup.subtree_control. An *ErrControllerNotThreaded is returned otherwise.
+//
+// Processes must be added to the threaded root, or to one of its threaded
+// descendants, before their threads can be moved with AddThread or MoveThreads.
+func (c *Manager) NewThreadedChild(name string, resources *Resources) (*Manager, error) {
+	if strings.HasPrefix(name, "/") {
+		return nil, errors.New("name must be relative")
+	}
+	var controllers []string
+	if resources != nil {
+		controllers = resources.EnabledControllers()
+	}
+	for _, controller := range controllers {
+		if _, ok := threadedControllers[controller]; !ok {
+			return nil, &ErrControllerNotThreaded{Controller: controller}
+		}
+	}
+	cgType, err := c.GetType()
+	switch {
+	case errors.Is(err, os.ErrNotExist) && c.path == filepath.Clean(c.unifiedMountpoint):
+		// the root cgroup has no type, and is always a valid threaded root
+	case err != nil:
+		return nil, err
+	case cgType == DomainInvalid:
+		return nil, fmt.Errorf("cgroups: %q is an invalid domain cgroup, it must be made threaded first", c.path)
+	case cgType == Domain:
+		data, err := c.readFile(subtreeControl)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, controller := range strings.Fields(string(data)) {
+			if _, ok := threadedControllers[controller]; !ok {
+				return nil, &ErrControllerNotThreaded{Controller: controller, Path: c.path}
+			}
+		}
+	}
+
+	m, err := c.NewChild(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.newThreaded(controllers, resources); err != nil {
+		// clean up cgroup dir on failure
+		m.Close()
+		c.removeChild(name)
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *Manager) newThreaded(controllers []string, resources *Resources) error {
+	if err := c.SetType(Threaded); err != nil {
+		return fmt.Errorf("failed to make %q threaded: %w", c.path, err)
+	}
+	if err := c.ToggleControllers(controllers, Enable); err != nil {
+		return err
+	}
+	return c.setResources(resources)
+}
+
+// MoveThreads moves individual threads of the process pid to the cgroups they
+// are mapped to. The cgroups must be threaded cgroups, or the root of the
+// threaded subtree, the process is a member of.
+//
+// All the threads are checked to belong to the process before any of them is
+// moved.
+func MoveThreads(pid int, threads map[int]*Manager) error {
+	tids := make([]int, 0, len(threads))
+	for tid, m := range threads {
+		if m == nil {
+			return fmt.Errorf("cgroups: no cgroup for thread %d", tid)
+		}
+		if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid), "task", strconv.Itoa(tid))); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("cgroups: %d is not a thread of process %d: %w", tid, pid, err)
+			}
+			return err
+		}
+		cgType, err := m.GetType()
+		if err != nil {
+			return err
+		}
+		if cgType != Threaded && cgType != DomainThreaded {
+			return fmt.Errorf("cgroups: can't move thread %d to %q of type %q", tid, m.path, cgType)
+		}
+		tids = append(tids, tid)
+	}
+	sort.Ints(tids)
+	for _, tid := range tids {
+		m := threads[tid]
+		if err := m.AddThread(uint64(tid)); err != nil {
+			return fmt.Errorf("failed to move thread %d of process %d to %q: %w", tid, pid, m.path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestNewThreadedChildValidation(t *testing.T) {
+	root := t.TempDir()
+	parent := filepath.Join(root, "parent")
+	require.NoError(t, os.Mkdir(parent, defaultDirPerm))
+	require.NoError(t, os.WriteFile(filepath.Join(parent, typeFile), []byte("domain\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(parent, subtreeControl), []byte("cpu memory\n"), 0o644))
+	c := &Manager{unifiedMountpoint: root, path: parent}
+
+	var notThreaded *ErrControllerNotThreaded
+	_, err := c.NewThreadedChild("threaded", &Resources{Memory: &Memory{}})
+	require.True(t, errors.As(err, &notThreaded), "unexpected error %v", err)
+	assert.Equal(t, "memory", notThreaded.Controller)
+	assert.Empty(t, notThreaded.Path)
+
+	_, err = c.NewThreadedChild("threaded", &Resources{CPU: &CPU{}})
+	require.True(t, errors.As(err, &notThreaded), "unexpected error %v", err)
+	assert.Equal(t, "memory", notThreaded.Controller)
+	assert.Equal(t, parent, notThreaded.Path)
+	assert.NoDirExists(t, filepath.Join(parent, "threaded"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(parent, typeFile), []byte("domain invalid\n"), 0o644))
+	_, err = c.NewThreadedChild("threaded", nil)
+	assert.Error(t, err)
+}
+
+func TestMoveThreadsValidation(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, typeFile), []byte("domain\n"), 0o644))
+	c := &Manager{unifiedMountpoint: root, path: root}
+
+	pid := os.Getpid()
+	assert.Error(t, MoveThreads(pid, map[int]*Manager{unix.Gettid(): nil}))
+	assert.Error(t, MoveThreads(pid, map[int]*Manager{1 << 30: c}), "not a thread of the process")
+	assert.Error(t, MoveThreads(pid, map[int]*Manager{pid: c}), "not a threaded cgroup")
+	_, err := os.Stat(filepath.Join(root, cgroupThreads))
+	assert.True(t, os.IsNotExist(err), "no thread must be moved")
+}
+
+func TestThreadedSubtree(t *testing.T) {
+	checkCgroupMode(t)
+	root, err := NewManager(defaultCgroup2Path, "/test-threaded", ToResources(&specs.LinuxResources{}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = root.Kill()
+		_ = os.Remove(filepath.Join(root.path, "a"))
+		_ = os.Remove(filepath.Join(root.path, "b"))
+		_ = root.Delete()
+	})
+
+	a, err := root.NewThreadedChild("a", nil)
+	require.NoError(t, err)
+	b, err := root.NewThreadedChild("b", nil)
+	require.NoError(t, err)
+	cgType, err := root.GetType()
+	require.NoError(t, err)
+	assert.Equal(t, DomainThreaded, cgType)
+	cgType, err = a.GetType()
+	require.NoError(t, err)
+	assert.Equal(t, Threaded, cgType)
+
+	_, err = root.NewThreadedChild("c", &Resources{Memory: &Memory{}})
+	var notThreaded *ErrControllerNotThreaded
+	assert.True(t, errors.As(err, &notThreaded))
+
+	// a process whose threads can be moved around
+	cmd := exec.Command("sleep", "infinity")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+	require.NoError(t, cmd.Start())
+	go func() {
+		_ = cmd.Wait()
+	}()
+	pid := cmd.Process.Pid
+	require.NoError(t, root.AddProc(uint64(pid)))
+	require.NoError(t, MoveThreads(pid, map[int]*Manager{pid: b}))
+
+	threads, err := b.Threads(false)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{uint64(pid)}, threads)
+	threads, err = a.Threads(false)
+	require.NoError(t, err)
+	assert.Empty(t, threads)
+}
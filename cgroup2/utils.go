@@ -32,9 +32,8 @@ import (
 
 	"github.com/containerd/cgroups/v3/cgroup2/stats"
 
+	"github.com/containerd/cgroups/v3"
 	"github.com/godbus/dbus/v5"
-	"github.com/opencontainers/runtime-spec/specs-go"
-	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
 )
 
@@ -44,13 +43,6 @@ const (
 	defaultDirPerm = 0o755
 )
 
-// defaultFilePerm is a var so that the test framework can change the filemode
-// of all files created when the tests are running.  The difference between the
-// tests and real world use is that files like "cgroup.procs" will exist when writing
-// to a read cgroup filesystem and do not exist prior when running in the tests.
-// this is set to a non 0 value in the test code
-var defaultFilePerm = os.FileMode(0)
-
 // remove will remove a cgroup path handling EAGAIN and EBUSY errors and
 // retrying the remove after a exp timeout
 func remove(path string) error {
@@ -65,7 +57,7 @@ func remove(path string) error {
 			return nil
 		}
 	}
-	return fmt.Errorf("cgroups: unable to remove path %q: %w", path, err)
+	return cgroups.NewError("remove", path, "", "", err)
 }
 
 // parseCgroupTasksFile parses /sys/fs/cgroup/$GROUPPATH/cgroup.procs or
@@ -76,9 +68,13 @@ func parseCgroupTasksFile(path string) ([]uint64, error) {
 		return nil, err
 	}
 	defer f.Close()
+	return parseCgroupTasks(f)
+}
+
+func parseCgroupTasks(r io.Reader) ([]uint64, error) {
 	var (
 		out []uint64
-		s   = bufio.NewScanner(f)
+		s   = bufio.NewScanner(r)
 	)
 	for s.Scan() {
 		if t := s.Text(); t != "" {
@@ -104,6 +100,15 @@ func parseKV(raw string) (string, uint64, error) {
 	return parts[0], v, err
 }
 
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func parseUint(s string, base, bitSize int) (uint64, error) {
 	v, err := strconv.ParseUint(s, base, bitSize)
 	if err != nil {
@@ -153,94 +158,6 @@ func parseCgroupFromReader(r io.Reader) (string, error) {
 	return "", fmt.Errorf("cgroup path not found")
 }
 
-// ToResources converts the oci LinuxResources struct into a
-// v2 Resources type for use with this package.
-//
-// converting cgroups configuration from v1 to v2
-// ref: https://github.com/containers/crun/blob/master/crun.1.md#cgroup-v2
-func ToResources(spec *specs.LinuxResources) *Resources {
-	var resources Resources
-	if cpu := spec.CPU; cpu != nil {
-		resources.CPU = &CPU{
-			Cpus: cpu.Cpus,
-			Mems: cpu.Mems,
-		}
-		if shares := cpu.Shares; shares != nil {
-			convertedWeight := 1 + ((*shares-2)*9999)/262142
-			resources.CPU.Weight = &convertedWeight
-		}
-		if period := cpu.Period; period != nil {
-			resources.CPU.Max = NewCPUMax(cpu.Quota, period)
-		}
-	}
-	if mem := spec.Memory; mem != nil {
-		resources.Memory = &Memory{}
-		if swap := mem.Swap; swap != nil {
-			resources.Memory.Swap = swap
-			if l := mem.Limit; l != nil {
-				reduce := *swap - *l
-				resources.Memory.Swap = &reduce
-			}
-		}
-		if l := mem.Limit; l != nil {
-			resources.Memory.Max = l
-		}
-		if l := mem.Reservation; l != nil {
-			resources.Memory.Low = l
-		}
-	}
-	if hugetlbs := spec.HugepageLimits; hugetlbs != nil {
-		hugeTlbUsage := HugeTlb{}
-		for _, hugetlb := range hugetlbs {
-			hugeTlbUsage = append(hugeTlbUsage, HugeTlbEntry{
-				HugePageSize: hugetlb.Pagesize,
-				Limit:        hugetlb.Limit,
-			})
-		}
-		resources.HugeTlb = &hugeTlbUsage
-	}
-	if pids := spec.Pids; pids != nil {
-		resources.Pids = &Pids{
-			Max: pids.Limit,
-		}
-	}
-	if i := spec.BlockIO; i != nil {
-		resources.IO = &IO{}
-		if i.Weight != nil {
-			resources.IO.BFQ.Weight = 1 + (*i.Weight-10)*9999/990
-		}
-		for t, devices := range map[IOType][]specs.LinuxThrottleDevice{
-			ReadBPS:   i.ThrottleReadBpsDevice,
-			WriteBPS:  i.ThrottleWriteBpsDevice,
-			ReadIOPS:  i.ThrottleReadIOPSDevice,
-			WriteIOPS: i.ThrottleWriteIOPSDevice,
-		} {
-			for _, d := range devices {
-				resources.IO.Max = append(resources.IO.Max, Entry{
-					Type:  t,
-					Major: d.Major,
-					Minor: d.Minor,
-					Rate:  d.Rate,
-				})
-			}
-		}
-	}
-	if i := spec.Rdma; i != nil {
-		resources.RDMA = &RDMA{}
-		for device, value := range spec.Rdma {
-			if device != "" && (value.HcaHandles != nil && value.HcaObjects != nil) {
-				resources.RDMA.Limit = append(resources.RDMA.Limit, RDMAEntry{
-					Device:     device,
-					HcaHandles: *value.HcaHandles,
-					HcaObjects: *value.HcaObjects,
-				})
-			}
-		}
-	}
-
-	return &resources
-}
-
 // Gets uint64 parsed content of single value cgroup stat file
 func getStatFileContentUint64(filePath string) uint64 {
 	f, err := os.Open(filePath)
@@ -248,7 +165,10 @@ func getStatFileContentUint64(filePath string) uint64 {
 		return 0
 	}
 	defer f.Close()
+	return readStatUint64(f, cgroups.GetLogger())
+}
 
+func readStatUint64(f *os.File, log cgroups.Logger) uint64 {
 	// We expect an unsigned 64 bit integer, or a "max" string
 	// in some cases.
 	buf := make([]byte, 32)
@@ -264,7 +184,7 @@ func getStatFileContentUint64(filePath string) uint64 {
 
 	res, err := parseUint(trimmed, 10, 64)
 	if err != nil {
-		logrus.Errorf("unable to parse %q as a uint from Cgroup file %q", trimmed, filePath)
+		log.Error("unable to parse value as a uint from cgroup file", "value", trimmed, "file", f.Name(), "error", err)
 		return res
 	}
 
@@ -272,13 +192,16 @@ func getStatFileContentUint64(filePath string) uint64 {
 }
 
 func readIoStats(path string) []*stats.IOEntry {
-	// more details on the io.stat file format: https://www.kernel.org/doc/Documentation/cgroup-v2.txt
-	var usage []*stats.IOEntry
-	fpath := filepath.Join(path, "io.stat")
-	currentData, err := os.ReadFile(fpath)
+	currentData, err := os.ReadFile(filepath.Join(path, "io.stat"))
 	if err != nil {
-		return usage
+		return nil
 	}
+	return parseIoStats(currentData)
+}
+
+func parseIoStats(currentData []byte) []*stats.IOEntry {
+	// more details on the io.stat file format: https://www.kernel.org/doc/Documentation/cgroup-v2.txt
+	var usage []*stats.IOEntry
 	entries := strings.Split(string(currentData), "\n")
 
 	for _, entry := range entries {
@@ -394,12 +317,19 @@ func systemdUnitFromPath(path string) string {
 }
 
 func readHugeTlbStats(path string) []*stats.HugeTlbStat {
+	return hugeTlbStats(func(name string) uint64 {
+		return getStatFileContentUint64(filepath.Join(path, name))
+	})
+}
+
+// hugeTlbStats reads the hugetlb stats of every huge page size of the host with read
+func hugeTlbStats(read func(name string) uint64) []*stats.HugeTlbStat {
 	hpSizes := hugePageSizes()
 	usage := make([]*stats.HugeTlbStat, len(hpSizes))
 	for idx, pagesize := range hpSizes {
 		usage[idx] = &stats.HugeTlbStat{
-			Max:      getStatFileContentUint64(filepath.Join(path, "hugetlb."+pagesize+".max")),
-			Current:  getStatFileContentUint64(filepath.Join(path, "hugetlb."+pagesize+".current")),
+			Max:      read("hugetlb." + pagesize + ".max"),
+			Current:  read("hugetlb." + pagesize + ".current"),
 			Pagesize: pagesize,
 		}
 	}
@@ -432,7 +362,7 @@ func hugePageSizes() []string {
 
 		hPageSizes, err = getHugePageSizeFromFilenames(files)
 		if err != nil {
-			logrus.Warnf("hugePageSizes: %s", err)
+			cgroups.GetLogger().Warn("failed to read huge page sizes", "error", err)
 		}
 	})
 
@@ -490,7 +420,10 @@ func getStatPSIFromFile(path string) *stats.PSIStats {
 		return nil
 	}
 	defer f.Close()
+	return readStatPSI(f, cgroups.GetLogger())
+}
 
+func readStatPSI(f *os.File, log cgroups.Logger) *stats.PSIStats {
 	psistats := &stats.PSIStats{}
 	sc := bufio.NewScanner(f)
 	for sc.Scan() {
@@ -505,16 +438,16 @@ func getStatPSIFromFile(path string) *stats.PSIStats {
 			pv = psistats.Full
 		}
 		if pv != nil {
-			err = parsePSIData(parts[1:], pv)
+			err := parsePSIData(parts[1:], pv)
 			if err != nil {
-				logrus.Errorf("failed to read file %s: %v", path, err)
+				log.Error("failed to read PSI file", "file", f.Name(), "error", err)
 				return nil
 			}
 		}
 	}
 
 	if err := sc.Err(); err != nil {
-		logrus.Errorf("unable to parse PSI data: %v", err)
+		log.Error("unable to parse PSI data", "file", f.Name(), "error", err)
 		return nil
 	}
 	return psistats
@@ -26,6 +26,7 @@ import (
 
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParseCgroupFromReader(t *testing.T) {
@@ -100,6 +101,39 @@ func TestToResources(t *testing.T) {
 	assert.Equal(t, CPUMax("max 10000"), v2resources2.CPU.Max)
 }
 
+func TestToResourcesSwap(t *testing.T) {
+	var (
+		zero int64
+		mem  int64 = 300
+	)
+	// an explicit swap of 0 leaves the swap limit unset
+	v2resources := ToResources(&specs.LinuxResources{Memory: &specs.LinuxMemory{Swap: &zero}})
+	assert.Nil(t, v2resources.Memory.Swap)
+	v2resources = ToResources(&specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: &mem, Swap: &zero}})
+	assert.Nil(t, v2resources.Memory.Swap)
+	assert.Equal(t, mem, *v2resources.Memory.Max)
+
+	// a swap equal to the limit disables swap
+	v2resources = ToResources(&specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: &mem, Swap: &mem}})
+	require.NotNil(t, v2resources.Memory.Swap)
+	assert.Equal(t, int64(0), *v2resources.Memory.Swap)
+}
+
+func TestToResourcesBlockIOAndDevices(t *testing.T) {
+	var weight uint16 = 500
+	devices := []specs.LinuxDeviceCgroup{
+		{Allow: false, Access: "rwm"},
+		{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rwm"},
+	}
+	v2resources := ToResources(&specs.LinuxResources{
+		BlockIO: &specs.LinuxBlockIO{Weight: &weight},
+		Devices: devices,
+	})
+	// io.bfq.weight has the range of blkio.weight
+	assert.Equal(t, weight, v2resources.IO.BFQ.Weight)
+	assert.Equal(t, devices, v2resources.Devices)
+}
+
 func BenchmarkGetStatFileContentUint64(b *testing.B) {
 	b.ReportAllocs()
 
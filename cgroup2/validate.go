@@ -0,0 +1,275 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationContext is the state of the host and of the parent cgroup that
+// resources are validated against. The checks that need a field that is not set
+// are skipped.
+type ValidationContext struct {
+	// Controllers are the controllers available to the cgroup, as listed in
+	// the cgroup.controllers file of its parent.
+	Controllers []string
+	// EffectiveCpus and EffectiveMems are the cpus and memory nodes the parent
+	// is allowed to use, as listed in its cpuset.cpus.effective and
+	// cpuset.mems.effective files.
+	EffectiveCpus string
+	EffectiveMems string
+	// HugePageSizes are the huge page sizes of the host, e.g. "2MB". The sizes
+	// found in /sys/kernel/mm/hugepages are used when it is nil.
+	HugePageSizes []string
+}
+
+// NewValidationContext returns the context to validate the resources of a
+// child of parent against.
+func NewValidationContext(parent *Manager) (ValidationContext, error) {
+	var ctx ValidationContext
+	controllers, err := parent.readResource(controllersFile)
+	if err != nil {
+		return ctx, err
+	}
+	ctx.Controllers = strings.Fields(controllers)
+	if ctx.EffectiveCpus, err = parent.readResource("cpuset.cpus.effective"); err != nil {
+		return ctx, err
+	}
+	if ctx.EffectiveMems, err = parent.readResource("cpuset.mems.effective"); err != nil {
+		return ctx, err
+	}
+	return ctx, nil
+}
+
+// ValidationError describes an invalid resource.
+type ValidationError struct {
+	// Field is the name of the invalid field, e.g. "CPU.Weight".
+	Field string
+	// Value is the invalid value.
+	Value interface{}
+	// Reason explains why the value is invalid.
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("cgroups: invalid %s %v: %s", e.Field, e.Value, e.Reason)
+}
+
+// ValidationErrors are all the problems found by Resources.Validate.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks that the resources are within the ranges accepted by the
+// kernel, that their values are well formed, and that they are compatible with
+// ctx. All the problems are returned at once as ValidationErrors.
+func (r *Resources) Validate(ctx ValidationContext) error {
+	var errs ValidationErrors
+	invalid := func(field string, value interface{}, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{Field: field, Value: value, Reason: fmt.Sprintf(format, args...)})
+	}
+	if ctx.Controllers != nil {
+		for _, controller := range r.EnabledControllers() {
+			if !contains(ctx.Controllers, controller) {
+				invalid("controller", controller, "not available, the parent provides %v", ctx.Controllers)
+			}
+		}
+	}
+	if cpu := r.CPU; cpu != nil {
+		if cpu.Weight != nil && (*cpu.Weight < 1 || *cpu.Weight > 10000) {
+			invalid("CPU.Weight", *cpu.Weight, "must be between 1 and 10000")
+		}
+		if cpu.Idle != nil && *cpu.Idle > 1 {
+			invalid("CPU.Idle", *cpu.Idle, "must be 0 or 1")
+		}
+		var quota int64
+		if cpu.Max != "" {
+			var reason string
+			quota, reason = validateCPUMax(cpu.Max)
+			if reason != "" {
+				invalid("CPU.Max", string(cpu.Max), reason)
+			}
+		}
+		if cpu.Burst != nil && quota > 0 && *cpu.Burst > uint64(quota) {
+			invalid("CPU.Burst", *cpu.Burst, "must not be greater than the quota %d", quota)
+		}
+		for _, s := range []struct {
+			field, value, effective string
+		}{
+			{"CPU.Cpus", cpu.Cpus, ctx.EffectiveCpus},
+			{"CPU.Mems", cpu.Mems, ctx.EffectiveMems},
+		} {
+			if s.value == "" {
+				continue
+			}
+			set, err := parseCPUSet(s.value)
+			if err != nil {
+				invalid(s.field, s.value, "%v", err)
+				continue
+			}
+			if s.effective == "" {
+				continue
+			}
+			effective, err := parseCPUSet(s.effective)
+			if err != nil {
+				continue
+			}
+			var missing []int
+			for n := 0; n < len(set)*8; n++ {
+				if set.has(n) && !effective.has(n) {
+					missing = append(missing, n)
+				}
+			}
+			if len(missing) > 0 {
+				invalid(s.field, s.value, "%v not in the effective set %q of the parent", missing, s.effective)
+			}
+		}
+	}
+	if mem := r.Memory; mem != nil {
+		for _, m := range []struct {
+			field string
+			value *int64
+		}{
+			{"Memory.Swap", mem.Swap},
+			{"Memory.Min", mem.Min},
+			{"Memory.Max", mem.Max},
+			{"Memory.Low", mem.Low},
+			{"Memory.High", mem.High},
+		} {
+			if m.value != nil && *m.value < -1 {
+				invalid(m.field, *m.value, "must be positive, or -1 for no limit")
+			}
+		}
+	}
+	if io := r.IO; io != nil {
+		if io.BFQ.Weight != 0 && (io.BFQ.Weight < 1 || io.BFQ.Weight > 1000) {
+			invalid("IO.BFQ.Weight", io.BFQ.Weight, "must be between 1 and 1000")
+		}
+		for _, d := range io.BFQ.WeightDevice {
+			if d.Weight < 1 || d.Weight > 1000 {
+				invalid("IO.BFQ.WeightDevice", d.String(), "weight must be between 1 and 1000")
+			}
+			if d.Major < 0 || d.Minor < 0 {
+				invalid("IO.BFQ.WeightDevice", d.String(), "invalid device number")
+			}
+		}
+		for _, e := range io.Max {
+			switch e.Type {
+			case ReadBPS, WriteBPS, ReadIOPS, WriteIOPS:
+			default:
+				invalid("IO.Max", e.String(), "unknown type %q", e.Type)
+			}
+			if e.Major < 0 || e.Minor < 0 {
+				invalid("IO.Max", e.String(), "invalid device number")
+			}
+		}
+	}
+	if rdma := r.RDMA; rdma != nil {
+		for _, e := range rdma.Limit {
+			if e.Device == "" || strings.ContainsAny(e.Device, " \n") {
+				invalid("RDMA.Limit", e.String(), "invalid device name %q", e.Device)
+			}
+		}
+	}
+	if hugetlb := r.HugeTlb; hugetlb != nil {
+		sizes := ctx.HugePageSizes
+		if sizes == nil {
+			sizes = hugePageSizes()
+		}
+		for _, e := range *hugetlb {
+			if len(sizes) > 0 && !contains(sizes, e.HugePageSize) {
+				invalid("HugeTlb.HugePageSize", e.HugePageSize, "not supported by the host, which supports %v", sizes)
+			}
+		}
+	}
+	for k := range r.Unified {
+		if err := validateUnifiedKey(k); err != nil {
+			invalid("Unified", k, "not a file of the cgroup")
+		}
+	}
+	if len(errs) > 0 {
+		// map iteration makes the order random
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		return errs
+	}
+	return nil
+}
+
+// validateCPUMax returns the quota of max, and the reason it is invalid if it is.
+// The kernel accepts periods between 1ms and 1s, and quotas of at least 1ms.
+func validateCPUMax(max CPUMax) (int64, string) {
+	quota, period, err := max.parse()
+	if err != nil {
+		return 0, err.Error()
+	}
+	if quota != -1 && quota < 1000 {
+		return 0, "quota must be at least 1000"
+	}
+	if period < 1000 || period > 1000000 {
+		return 0, "period must be between 1000 and 1000000"
+	}
+	return quota, ""
+}
+
+// maxCPUSetID bounds the cpus and memory nodes of a list, the kernel supports
+// at most 8192 cpus (NR_CPUS) and fewer memory nodes.
+const maxCPUSetID = 8191
+
+// cpuSet is a bitmask of cpus or memory nodes, with the bit n%8 of the byte n/8
+// set for n, as used by the AllowedCPUs and AllowedMemoryNodes properties.
+type cpuSet []byte
+
+func (s cpuSet) has(n int) bool {
+	return n/8 < len(s) && s[n/8]&(1<<(n%8)) != 0
+}
+
+// parseCPUSet parses a list of cpus or memory nodes, like "0-3,7".
+func parseCPUSet(s string) (cpuSet, error) {
+	var set cpuSet
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid list %q", s)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+		}
+		if end > maxCPUSetID {
+			return nil, fmt.Errorf("%d is greater than the maximum %d", end, maxCPUSetID)
+		}
+		for len(set) <= end/8 {
+			set = append(set, 0)
+		}
+		for n := start; n <= end; n++ {
+			set[n/8] |= 1 << (n % 8)
+		}
+	}
+	return set, nil
+}
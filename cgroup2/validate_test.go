@@ -0,0 +1,135 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroup2
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	ctx := ValidationContext{
+		Controllers:   []string{"cpu", "cpuset", "memory", "hugetlb"},
+		EffectiveCpus: "0-3",
+		EffectiveMems: "0",
+		HugePageSizes: []string{"2MB", "1GB"},
+	}
+	valid := &Resources{
+		CPU: &CPU{
+			Weight: uint64Ptr(100),
+			Max:    NewCPUMax(int64Ptr(50000), uint64Ptr(100000)),
+			Burst:  uint64Ptr(10000),
+			Cpus:   "0-1,3",
+			Mems:   "0",
+		},
+		Memory:  &Memory{Max: int64Ptr(-1), Swap: int64Ptr(0)},
+		HugeTlb: &HugeTlb{{HugePageSize: "2MB", Limit: 1 << 21}},
+		Unified: map[string]string{"memory.oom.group": "1"},
+	}
+	require.NoError(t, valid.Validate(ctx))
+
+	invalid := &Resources{
+		CPU: &CPU{
+			Weight: uint64Ptr(0),
+			Idle:   uint64Ptr(2),
+			Max:    CPUMax("100 100000"),
+			Cpus:   "2-5",
+			Mems:   "0-",
+		},
+		Memory:  &Memory{Max: int64Ptr(-2)},
+		Pids:    &Pids{Max: 10},
+		IO:      &IO{BFQ: BFQ{Weight: 5000, WeightDevice: []BFQDeviceWeight{{Major: 8, Weight: 0}}}, Max: []Entry{{Type: "bps", Major: 8}}},
+		HugeTlb: &HugeTlb{{HugePageSize: "16MB"}},
+	}
+	err := invalid.Validate(ctx)
+	var errs ValidationErrors
+	require.True(t, errors.As(err, &errs), "unexpected error %v", err)
+	fields := make(map[string]int)
+	for _, e := range errs {
+		fields[e.Field]++
+	}
+	assert.Equal(t, map[string]int{
+		"controller":           2, // pids and io
+		"CPU.Weight":           1,
+		"CPU.Idle":             1,
+		"CPU.Max":              1,
+		"CPU.Cpus":             1,
+		"CPU.Mems":             1,
+		"Memory.Max":           1,
+		"IO.BFQ.Weight":        1,
+		"IO.BFQ.WeightDevice":  1,
+		"IO.Max":               1,
+		"HugeTlb.HugePageSize": 1,
+	}, fields)
+
+	// without a context only the values are checked
+	require.NoError(t, (&Resources{Pids: &Pids{Max: 10}, CPU: &CPU{Cpus: "7"}}).Validate(ValidationContext{}))
+}
+
+func TestParseCPUSet(t *testing.T) {
+	set, err := parseCPUSet("0-1,3,9")
+	require.NoError(t, err)
+	assert.Equal(t, cpuSet{0b1011, 0b10}, set)
+	for n := 0; n < 16; n++ {
+		assert.Equal(t, n <= 1 || n == 3 || n == 9, set.has(n), n)
+	}
+
+	set, err = parseCPUSet("8191")
+	require.NoError(t, err)
+	assert.Len(t, set, 1024)
+	for _, s := range []string{"", "a", "-1", "3-1", "0-", "8192", "0-2000000000"} {
+		_, err := parseCPUSet(s)
+		assert.Error(t, err, s)
+	}
+
+	// the huge ranges are rejected, not expanded
+	err = (&Resources{CPU: &CPU{Cpus: "0-2000000000"}}).Validate(ValidationContext{EffectiveCpus: "0-3"})
+	var errs ValidationErrors
+	require.True(t, errors.As(err, &errs), "unexpected error %v", err)
+	assert.Equal(t, "CPU.Cpus", errs[0].Field)
+}
+
+func TestValidateCPUMax(t *testing.T) {
+	for max, valid := range map[CPUMax]bool{
+		"max":            true,
+		"max 100000":     true,
+		"1000 1000":      true,
+		"50000 1000000":  true,
+		"999 100000":     false,
+		"1000 999":       false,
+		"1000 1000001":   false,
+		"abc 100000":     false,
+		"1000 100000 10": false,
+	} {
+		_, reason := validateCPUMax(max)
+		assert.Equal(t, valid, reason == "", "%q: %s", max, reason)
+	}
+}
+
+func TestNewValidationContext(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, controllersFile), []byte("cpuset cpu\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "cpuset.cpus.effective"), []byte("0-7\n"), 0o644))
+	ctx, err := NewValidationContext(&Manager{unifiedMountpoint: root, path: root})
+	require.NoError(t, err)
+	assert.Equal(t, ValidationContext{Controllers: []string{"cpuset", "cpu"}, EffectiveCpus: "0-7"}, ctx)
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrInvalidFormat       = errors.New("cgroups: parsing file with invalid format failed")
+	ErrCgroupDeleted       = errors.New("cgroups: cgroup deleted")
+	ErrFreezerNotSupported = errors.New("cgroups: freezer cgroup not supported on this system")
+	ErrMemoryNotSupported  = errors.New("cgroups: memory cgroup not supported on this system")
+)
+
+// Error is returned when an operation on a cgroup, or on one of its files,
+// fails. The errno returned by the kernel is wrapped, and can be checked with
+// errors.Is or with IsDeleted, IsBusy, IsNotSupported and IsInvalid.
+type Error struct {
+	// Op is the failed operation, e.g. "read", "write" or "remove".
+	Op string
+	// Path is the full path of the cgroup, in the hierarchy of a subsystem on
+	// cgroup v1.
+	Path string
+	// File is the name of the file of the cgroup, if the operation was on a
+	// file.
+	File string
+	// Value is the value written, if any.
+	Value string
+	Err   error
+}
+
+func (e *Error) Error() string {
+	target := e.Path
+	if e.File != "" {
+		target = filepath.Join(e.Path, e.File)
+	}
+	if e.Value != "" {
+		return fmt.Sprintf("cgroups: %s %q to %s: %v", e.Op, e.Value, target, e.Err)
+	}
+	return fmt.Sprintf("cgroups: %s %s: %v", e.Op, target, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NewError returns the *Error for err. The *os.PathError returned by the os
+// package is unwrapped, as Error already describes the file.
+func NewError(op, path, file, value string, err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return &Error{Op: op, Path: path, File: file, Value: value, Err: err}
+}
+
+// IsDeleted returns whether err was caused by the cgroup, or the file, having
+// been removed.
+func IsDeleted(err error) bool {
+	return errors.Is(err, ErrCgroupDeleted) || errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENODEV)
+}
+
+// IsBusy returns whether err was caused by the cgroup being in use, e.g. when
+// removing a cgroup with processes, or enabling a controller in the
+// cgroup.subtree_control file of a cgroup with processes.
+func IsBusy(err error) bool {
+	return errors.Is(err, unix.EBUSY)
+}
+
+// IsNotSupported returns whether err was caused by an operation the kernel
+// doesn't support, e.g. writing a controller file in a threaded cgroup, or by a
+// missing cgroup v1 subsystem.
+func IsNotSupported(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP) ||
+		errors.Is(err, ErrFreezerNotSupported) ||
+		errors.Is(err, ErrMemoryNotSupported)
+}
+
+// IsInvalid returns whether err was caused by a value the kernel rejected.
+func IsInvalid(err error) bool {
+	return errors.Is(err, unix.EINVAL) || errors.Is(err, ErrInvalidFormat)
+}
@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNewError(t *testing.T) {
+	err := NewError("write", "/sys/fs/cgroup/test", "pids.max", "10", &os.PathError{Op: "open", Path: "/sys/fs/cgroup/test/pids.max", Err: unix.ENOENT})
+	var cgErr *Error
+	if !errors.As(err, &cgErr) {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	if cgErr.Err != unix.ENOENT {
+		t.Errorf("the *os.PathError must be unwrapped, got %v", cgErr.Err)
+	}
+	if expected := `cgroups: write "10" to /sys/fs/cgroup/test/pids.max: no such file or directory`; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestErrorHelpers(t *testing.T) {
+	for _, tc := range []struct {
+		err                                  error
+		deleted, busy, notSupported, invalid bool
+	}{
+		{err: NewError("read", "/a", "memory.current", "", unix.ENODEV), deleted: true},
+		{err: fmt.Errorf("load: %w", ErrCgroupDeleted), deleted: true},
+		{err: &Error{Op: "remove", Path: "/a", Err: unix.EBUSY}, busy: true},
+		{err: NewError("write", "/a", "memory.max", "1", unix.EOPNOTSUPP), notSupported: true},
+		{err: ErrFreezerNotSupported, notSupported: true},
+		{err: NewError("write", "/a", "cpu.max", "x", unix.EINVAL), invalid: true},
+		{err: ErrInvalidFormat, invalid: true},
+		{err: errors.New("other")},
+	} {
+		if IsDeleted(tc.err) != tc.deleted || IsBusy(tc.err) != tc.busy || IsNotSupported(tc.err) != tc.notSupported || IsInvalid(tc.err) != tc.invalid {
+			t.Errorf("unexpected classification of %v", tc.err)
+		}
+	}
+}
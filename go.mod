@@ -4,7 +4,7 @@ go 1.18
 
 require (
 	github.com/cilium/ebpf v0.11.0
-	github.com/coreos/go-systemd/v22 v22.3.2
+	github.com/coreos/go-systemd/v22 v22.4.0
 	github.com/docker/go-units v0.4.0
 	github.com/godbus/dbus/v5 v5.0.4
 	github.com/opencontainers/runtime-spec v1.1.1-0.20230823135140-4fec88fd00a4
@@ -0,0 +1,94 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logger reports the problems that don't make an operation fail. The args are
+// alternating keys and values, as accepted by *slog.Logger, which satisfies
+// this interface.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+type loggerHolder struct {
+	Logger
+}
+
+var logger atomic.Value
+
+func init() {
+	logger.Store(loggerHolder{logrusLogger{}})
+}
+
+// SetLogger replaces the logger used by the managers that are not given a
+// logger of their own. A nil l restores the default logger, which
+// logs with the standard logrus logger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = logrusLogger{}
+	}
+	logger.Store(loggerHolder{l})
+}
+
+// GetLogger returns the logger set with SetLogger.
+func GetLogger() Logger {
+	return logger.Load().(loggerHolder).Logger
+}
+
+// logrusLogger logs with the standard logrus logger, the args become fields
+type logrusLogger struct{}
+
+func (logrusLogger) Debug(msg string, args ...any) {
+	logrus.WithFields(fields(args)).Debug(msg)
+}
+
+func (logrusLogger) Info(msg string, args ...any) {
+	logrus.WithFields(fields(args)).Info(msg)
+}
+
+func (logrusLogger) Warn(msg string, args ...any) {
+	logrus.WithFields(fields(args)).Warn(msg)
+}
+
+func (logrusLogger) Error(msg string, args ...any) {
+	logrus.WithFields(fields(args)).Error(msg)
+}
+
+// fields turns alternating keys and values into logrus fields. Like slog, a
+// value without a key is logged under !BADKEY.
+func fields(args []any) logrus.Fields {
+	f := make(logrus.Fields, len(args)/2)
+	for len(args) > 0 {
+		key, ok := args[0].(string)
+		if !ok || len(args) == 1 {
+			f["!BADKEY"] = args[0]
+			args = args[1:]
+			continue
+		}
+		f[key] = args[1]
+		args = args[2:]
+	}
+	return f
+}
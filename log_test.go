@@ -0,0 +1,63 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogrusFields(t *testing.T) {
+	err := errors.New("boom")
+	for _, tc := range []struct {
+		args     []any
+		expected logrus.Fields
+	}{
+		{nil, logrus.Fields{}},
+		{[]any{"path", "/a", "error", err}, logrus.Fields{"path": "/a", "error": err}},
+		{[]any{"path"}, logrus.Fields{"!BADKEY": "path"}},
+		{[]any{1, "path", "/a"}, logrus.Fields{"!BADKEY": 1, "path": "/a"}},
+	} {
+		if f := fields(tc.args); !reflect.DeepEqual(f, tc.expected) {
+			t.Errorf("fields(%v) = %v, expected %v", tc.args, f, tc.expected)
+		}
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+func TestSetLogger(t *testing.T) {
+	if _, ok := GetLogger().(logrusLogger); !ok {
+		t.Fatalf("unexpected default logger %T", GetLogger())
+	}
+	SetLogger(nopLogger{})
+	if _, ok := GetLogger().(nopLogger); !ok {
+		t.Errorf("unexpected logger %T", GetLogger())
+	}
+	SetLogger(nil)
+	if _, ok := GetLogger().(logrusLogger); !ok {
+		t.Errorf("nil must restore the default logger, got %T", GetLogger())
+	}
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// pidfdUnsupported is set once pidfd_open(2) returned ENOSYS (kernels older than 5.3)
+var pidfdUnsupported int32
+
+// ProcessHandle is a handle on a process found in a cgroup. When the kernel
+// supports it the handle is backed by a pidfd, which keeps referring to the same
+// process even if its pid gets recycled.
+type ProcessHandle struct {
+	pid int
+	fd  int
+}
+
+// openProcess opens a pidfd for pid. When pidfds are not supported, the returned
+// handle falls back to addressing the process by its pid.
+func openProcess(pid int) (*ProcessHandle, error) {
+	p := &ProcessHandle{pid: pid, fd: -1}
+	if atomic.LoadInt32(&pidfdUnsupported) != 0 {
+		return p, nil
+	}
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		if errors.Is(err, unix.ENOSYS) {
+			atomic.StoreInt32(&pidfdUnsupported, 1)
+			return p, nil
+		}
+		return nil, err
+	}
+	p.fd = fd
+	return p, nil
+}
+
+// Pid returns the process id of the process.
+func (p *ProcessHandle) Pid() int {
+	return p.pid
+}
+
+// Signal sends sig to the process. A sig of 0 only checks that the process is
+// still alive.
+func (p *ProcessHandle) Signal(sig unix.Signal) error {
+	if p.fd == -1 {
+		return unix.Kill(p.pid, sig)
+	}
+	return unix.PidfdSendSignal(p.fd, sig, nil, 0)
+}
+
+// Close releases the pidfd of the handle.
+func (p *ProcessHandle) Close() error {
+	if p.fd == -1 {
+		return nil
+	}
+	return unix.Close(p.fd)
+}
+
+// CloseProcesses closes every handle of procs.
+func CloseProcesses(procs []*ProcessHandle) {
+	for _, p := range procs {
+		p.Close()
+	}
+}
+
+// OpenProcesses opens a handle on each of the pids. After the handles are opened
+// the pids are listed again through list, and every process that is no longer
+// part of the list is dropped: its pid was recycled by a process outside of the
+// cgroup between the first listing and pidfd_open(2). Processes that exited in
+// the meantime are dropped as well.
+func OpenProcesses(pids []int, list func() ([]int, error)) ([]*ProcessHandle, error) {
+	var procs []*ProcessHandle
+	for _, pid := range pids {
+		p, err := openProcess(pid)
+		if err != nil {
+			if errors.Is(err, unix.ESRCH) {
+				continue
+			}
+			CloseProcesses(procs)
+			return nil, err
+		}
+		procs = append(procs, p)
+	}
+	if len(procs) == 0 || procs[0].fd == -1 {
+		return procs, nil
+	}
+	current, err := list()
+	if err != nil {
+		CloseProcesses(procs)
+		return nil, err
+	}
+	members := make(map[int]struct{}, len(current))
+	for _, pid := range current {
+		members[pid] = struct{}{}
+	}
+	verified := procs[:0]
+	for _, p := range procs {
+		if _, ok := members[p.pid]; !ok {
+			p.Close()
+			continue
+		}
+		verified = append(verified, p)
+	}
+	return verified, nil
+}
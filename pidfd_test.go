@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestOpenProcessesDropsRecycledPids(t *testing.T) {
+	cmd := exec.Command("sleep", "infinity")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	self, child := os.Getpid(), cmd.Process.Pid
+
+	// only the child is still listed after the pidfds were opened
+	procs, err := OpenProcesses([]int{self, child}, func() ([]int, error) {
+		return []int{child}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseProcesses(procs)
+
+	if pidfdUnsupported != 0 {
+		if len(procs) != 2 {
+			t.Fatalf("expected 2 processes without pidfds, got %d", len(procs))
+		}
+		return
+	}
+	if len(procs) != 1 {
+		t.Fatalf("expected 1 process, got %d", len(procs))
+	}
+	if procs[0].Pid() != child {
+		t.Errorf("expected pid %d, got %d", child, procs[0].Pid())
+	}
+	if err := procs[0].Signal(0); err != nil {
+		t.Errorf("the child must be alive: %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// clockTicks is the value of sysconf(_SC_CLK_TCK), which is a constant on Linux
+const clockTicks = 100
+
+// ProcessInfo describes a process, or a thread, of a cgroup with the details
+// found in /proc.
+type ProcessInfo struct {
+	// Pid is the process id of the process, or the thread id of a thread.
+	Pid int
+	// Comm is the command name of the process.
+	Comm string
+	// Cmdline is the command line of the process. It is empty for kernel threads
+	// and zombies.
+	Cmdline []string
+	// State is the single letter state of the process, e.g. "R" or "S".
+	State string
+	// StartTime is the time the process started at, relative to system boot.
+	StartTime time.Duration
+	// UID is the real user id of the process.
+	UID uint32
+	// RSS is the resident set size of the process in bytes.
+	RSS uint64
+	// CPUTime is the user and system time consumed by the process.
+	CPUTime time.Duration
+	// Path is the full path of the cgroup the process lives in.
+	Path string
+}
+
+// ReadProcessInfo reads the details of pid from /proc. When the process exited
+// before all of its details could be read, an error wrapping os.ErrNotExist is
+// returned.
+func ReadProcessInfo(pid int) (*ProcessInfo, error) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, processErr(pid, err)
+	}
+	info, err := parseProcStat(stat)
+	if err != nil {
+		return nil, fmt.Errorf("pid %d: %w", pid, err)
+	}
+	// Any of the remaining files may be unreadable, e.g. smaps_rollup of a process
+	// owned by another user. Only a process that is gone is treated as an error.
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		info.Cmdline = parseCmdline(cmdline)
+	} else if isProcessGone(err) {
+		return nil, processErr(pid, err)
+	}
+	if status, err := os.ReadFile(filepath.Join(dir, "status")); err == nil {
+		info.UID, _ = parseStatusUID(status)
+		if rss, ok := parseStatusKB(status, "VmRSS:"); ok {
+			info.RSS = rss
+		}
+	} else if isProcessGone(err) {
+		return nil, processErr(pid, err)
+	}
+	// smaps_rollup (kernels 4.14+) accounts shared pages more precisely than VmRSS
+	if rollup, err := os.ReadFile(filepath.Join(dir, "smaps_rollup")); err == nil {
+		if rss, ok := parseStatusKB(rollup, "Rss:"); ok {
+			info.RSS = rss
+		}
+	} else if isProcessGone(err) {
+		return nil, processErr(pid, err)
+	}
+	return info, nil
+}
+
+// parseProcStat parses the content of /proc/<pid>/stat.
+func parseProcStat(data []byte) (*ProcessInfo, error) {
+	// The command name is enclosed in parentheses and may contain any character,
+	// so the fields following it are found from the last closing parenthesis.
+	open, end := bytes.IndexByte(data, '('), bytes.LastIndexByte(data, ')')
+	if open < 1 || end < open {
+		return nil, errors.New("invalid stat format")
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data[:open])))
+	if err != nil {
+		return nil, err
+	}
+	// fields[0] is field 3 (state) in proc(5)
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return nil, errors.New("invalid stat format")
+	}
+	var ticks [3]uint64
+	for i, n := range []int{14, 15, 22} {
+		if ticks[i], err = strconv.ParseUint(fields[n-3], 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return &ProcessInfo{
+		Pid:       pid,
+		Comm:      string(data[open+1 : end]),
+		State:     fields[0],
+		CPUTime:   ticksToDuration(ticks[0] + ticks[1]),
+		StartTime: ticksToDuration(ticks[2]),
+	}, nil
+}
+
+func parseCmdline(data []byte) []string {
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(string(data), "\x00")
+}
+
+// parseStatusUID returns the real uid from the content of /proc/<pid>/status.
+func parseStatusUID(data []byte) (uint32, bool) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "Uid:" {
+			continue
+		}
+		uid, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		return uint32(uid), true
+	}
+	return 0, false
+}
+
+// parseStatusKB returns the value in bytes of a "<key> <value> kB" line, as found
+// in /proc/<pid>/status and /proc/<pid>/smaps_rollup.
+func parseStatusKB(data []byte, key string) (uint64, bool) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != key {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return v * 1024, true
+	}
+	return 0, false
+}
+
+func ticksToDuration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / clockTicks
+}
+
+// isProcessGone reports whether err was returned because the process exited. Reading
+// the files of a process that is being torn down fails with ESRCH instead of ENOENT.
+func isProcessGone(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, unix.ESRCH)
+}
+
+func processErr(pid int, err error) error {
+	if isProcessGone(err) {
+		return fmt.Errorf("pid %d: %w", pid, os.ErrNotExist)
+	}
+	return err
+}
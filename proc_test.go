@@ -0,0 +1,73 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseProcStat(t *testing.T) {
+	const data = "4242 (a (weird) cmd) S 1 4242 4242 0 -1 4194560 1 0 0 0 250 50 0 0 20 0 1 0 1234 0 0\n"
+	info, err := parseProcStat([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Pid != 4242 {
+		t.Fatalf("expected pid 4242, got %d", info.Pid)
+	}
+	if info.Comm != "a (weird) cmd" {
+		t.Fatalf("unexpected comm %q", info.Comm)
+	}
+	if info.State != "S" {
+		t.Fatalf("unexpected state %q", info.State)
+	}
+	if info.CPUTime != 3*time.Second {
+		t.Fatalf("unexpected cpu time %s", info.CPUTime)
+	}
+	if info.StartTime != 12340*time.Millisecond {
+		t.Fatalf("unexpected start time %s", info.StartTime)
+	}
+	if _, err := parseProcStat([]byte("4242 (cat R 1")); err == nil {
+		t.Fatal("expected an error for a truncated stat file")
+	}
+}
+
+func TestReadProcessInfo(t *testing.T) {
+	info, err := ReadProcessInfo(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Pid != os.Getpid() {
+		t.Fatalf("expected pid %d, got %d", os.Getpid(), info.Pid)
+	}
+	if info.UID != uint32(os.Getuid()) {
+		t.Fatalf("expected uid %d, got %d", os.Getuid(), info.UID)
+	}
+	if len(info.Cmdline) == 0 || info.Cmdline[0] != os.Args[0] {
+		t.Fatalf("unexpected cmdline %q", info.Cmdline)
+	}
+	if info.RSS == 0 {
+		t.Fatal("expected a non zero rss")
+	}
+
+	if _, err := ReadProcessInfo(1 << 30); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+}
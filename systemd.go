@@ -0,0 +1,173 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// unitNameMax is the longest unit name accepted by systemd.
+const unitNameMax = 255
+
+// unitTypes are the suffixes of the unit names.
+var unitTypes = []string{
+	"service", "socket", "target", "device", "mount", "automount",
+	"swap", "timer", "path", "slice", "scope",
+}
+
+// InvalidUnitNameError is returned for the unit and slice names that systemd
+// would reject.
+type InvalidUnitNameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidUnitNameError) Error() string {
+	return fmt.Sprintf("cgroups: invalid unit name %q: %s", e.Name, e.Reason)
+}
+
+// EscapeUnitName escapes s to be used as part of a unit name, like
+// systemd-escape does: "/" becomes "-", and the characters that are not
+// allowed in unit names, "-", "\" and a leading ".", are written as \xNN.
+func EscapeUnitName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && i == 0, c == '-', c == '\\', !isUnitNameChar(c):
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// UnescapeUnitName reverses EscapeUnitName.
+func UnescapeUnitName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '-':
+			b.WriteByte('/')
+		case '\\':
+			if i+3 >= len(s) || s[i+1] != 'x' {
+				return "", &InvalidUnitNameError{Name: s, Reason: "invalid escape sequence"}
+			}
+			n, err := strconv.ParseUint(s[i+2:i+4], 16, 8)
+			if err != nil {
+				return "", &InvalidUnitNameError{Name: s, Reason: "invalid escape sequence"}
+			}
+			b.WriteByte(byte(n))
+			i += 3
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// ValidateUnitName checks that name is a valid unit name: a non empty prefix
+// made of the characters allowed by systemd, followed by the unit type, e.g.
+// "my-container.scope".
+func ValidateUnitName(name string) error {
+	if len(name) > unitNameMax {
+		return &InvalidUnitNameError{Name: name, Reason: fmt.Sprintf("longer than %d characters", unitNameMax)}
+	}
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return &InvalidUnitNameError{Name: name, Reason: "missing unit type suffix"}
+	}
+	prefix, typ := name[:i], name[i+1:]
+	if !contains(unitTypes, typ) {
+		return &InvalidUnitNameError{Name: name, Reason: fmt.Sprintf("unknown unit type %q", typ)}
+	}
+	// instances of template units have an @ between the template and the
+	// instance name
+	if strings.Count(prefix, "@") > 1 || strings.HasPrefix(prefix, "@") {
+		return &InvalidUnitNameError{Name: name, Reason: "invalid template instance"}
+	}
+	for j := 0; j < len(prefix); j++ {
+		c := prefix[j]
+		if c == '\\' {
+			// only the \xNN escapes of EscapeUnitName are allowed
+			if j+3 >= len(prefix) || prefix[j+1] != 'x' || !isHexDigit(prefix[j+2]) || !isHexDigit(prefix[j+3]) {
+				return &InvalidUnitNameError{Name: name, Reason: "invalid escape sequence"}
+			}
+			j += 3
+			continue
+		}
+		if c != '@' && !isUnitNameChar(c) && c != '-' {
+			return &InvalidUnitNameError{Name: name, Reason: fmt.Sprintf("invalid character %q", c)}
+		}
+	}
+	return nil
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// ExpandSlice returns the path, relative to the root of the hierarchy, of the
+// cgroup of a slice. The "-" character separates the parent slices in the
+// name, so "test-a-b.slice" is "/test.slice/test-a.slice/test-a-b.slice", and
+// "-.slice" is the root slice.
+func ExpandSlice(slice string) (string, error) {
+	const suffix = ".slice"
+	if !strings.HasSuffix(slice, suffix) || len(slice) == len(suffix) {
+		return "", &InvalidUnitNameError{Name: slice, Reason: "not a slice"}
+	}
+	if strings.Contains(slice, "/") {
+		return "", &InvalidUnitNameError{Name: slice, Reason: "contains a path separator"}
+	}
+	if err := ValidateUnitName(slice); err != nil {
+		return "", err
+	}
+	name := strings.TrimSuffix(slice, suffix)
+	if name == "-" {
+		return "/", nil
+	}
+	var path, prefix string
+	for _, component := range strings.Split(name, "-") {
+		// neither test--a.slice, -test.slice nor test-.slice are valid
+		if component == "" {
+			return "", &InvalidUnitNameError{Name: slice, Reason: "empty slice component"}
+		}
+		path += "/" + prefix + component + suffix
+		prefix += component + "-"
+	}
+	return path, nil
+}
+
+// isUnitNameChar reports whether c is used as is in the escaped unit names.
+func isUnitNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == ':' || c == '_' || c == '.'
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
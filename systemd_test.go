@@ -0,0 +1,127 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cgroups
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEscapeUnitName(t *testing.T) {
+	for _, tc := range []struct {
+		input, escaped string
+	}{
+		{"foo", "foo"},
+		{"foo/bar", "foo-bar"},
+		{"foo-bar", `foo\x2dbar`},
+		{".hidden", `\x2ehidden`},
+		{"a.b", "a.b"},
+		{`back\slash`, `back\x5cslash`},
+		{"héllo wörld", `h\xc3\xa9llo\x20w\xc3\xb6rld`},
+	} {
+		escaped := EscapeUnitName(tc.input)
+		if escaped != tc.escaped {
+			t.Errorf("EscapeUnitName(%q) = %q, expected %q", tc.input, escaped, tc.escaped)
+		}
+		unescaped, err := UnescapeUnitName(escaped)
+		if err != nil {
+			t.Errorf("UnescapeUnitName(%q): %v", escaped, err)
+		}
+		if unescaped != tc.input {
+			t.Errorf("UnescapeUnitName(%q) = %q, expected %q", escaped, unescaped, tc.input)
+		}
+	}
+	for _, invalid := range []string{`foo\`, `foo\x2`, `foo\y2d`, `foo\xzz`} {
+		if _, err := UnescapeUnitName(invalid); err == nil {
+			t.Errorf("UnescapeUnitName(%q) must fail", invalid)
+		}
+	}
+}
+
+func TestValidateUnitName(t *testing.T) {
+	for _, name := range []string{
+		"foo.service",
+		"my-container.scope",
+		`foo\x2dbar.scope`,
+		"getty@tty1.service",
+		"user-1000.slice",
+	} {
+		if err := ValidateUnitName(name); err != nil {
+			t.Errorf("ValidateUnitName(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{
+		"",
+		"foo",
+		".scope",
+		"foo.unknown",
+		"../foo.scope",
+		"foo/bar.scope",
+		"héllo.scope",
+		"foo bar.scope",
+		"@foo.service",
+		"a@b@c.service",
+		`foo\.scope`,
+		`foo\x2.scope`,
+		`foo\xzz.scope`,
+		`foo\y2d.scope`,
+		strings.Repeat("a", 250) + ".scope",
+	} {
+		err := ValidateUnitName(name)
+		var invalid *InvalidUnitNameError
+		if !errors.As(err, &invalid) {
+			t.Errorf("ValidateUnitName(%q) = %v, expected an InvalidUnitNameError", name, err)
+		}
+	}
+}
+
+func TestExpandSlice(t *testing.T) {
+	for _, tc := range []struct {
+		slice, path string
+	}{
+		{"-.slice", "/"},
+		{"system.slice", "/system.slice"},
+		{"test-a.slice", "/test.slice/test-a.slice"},
+		{"test-a-b.slice", "/test.slice/test-a.slice/test-a-b.slice"},
+		{`foo\x2dbar.slice`, `/foo\x2dbar.slice`},
+	} {
+		path, err := ExpandSlice(tc.slice)
+		if err != nil {
+			t.Errorf("ExpandSlice(%q): %v", tc.slice, err)
+		}
+		if path != tc.path {
+			t.Errorf("ExpandSlice(%q) = %q, expected %q", tc.slice, path, tc.path)
+		}
+	}
+	for _, slice := range []string{
+		"",
+		".slice",
+		"foo.scope",
+		"foo/bar.slice",
+		"-foo.slice",
+		"foo-.slice",
+		"foo--bar.slice",
+		"héllo.slice",
+	} {
+		_, err := ExpandSlice(slice)
+		var invalid *InvalidUnitNameError
+		if !errors.As(err, &invalid) {
+			t.Errorf("ExpandSlice(%q) = %v, expected an InvalidUnitNameError", slice, err)
+		}
+	}
+}
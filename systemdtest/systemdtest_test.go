@@ -0,0 +1,60 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package systemdtest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	s := New(t.TempDir(), WithVersion("245"), WithControlGroup("/user.slice/user-1000.slice/user@1000.service"))
+	conn, err := s.Conn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for prop, expected := range map[string]string{
+		"Version":      `"245"`,
+		"ControlGroup": `"/user.slice/user-1000.slice/user@1000.service"`,
+	} {
+		if v, err := conn.GetManagerProperty(prop); err != nil || v != expected {
+			t.Errorf("%s = %s, %v; expected %s", prop, v, err, expected)
+		}
+	}
+
+	ctx := context.Background()
+	ch := make(chan string, 1)
+	if _, err := conn.StartTransientUnitContext(ctx, "a-b.slice", "replace", nil, ch); err != nil {
+		t.Fatal(err)
+	}
+	if result := <-ch; result != "done" {
+		t.Errorf("unexpected job result %q", result)
+	}
+	if _, err := os.Stat(filepath.Join(s.Mountpoint(), "/user.slice/user-1000.slice/user@1000.service/a.slice/a-b.slice")); err != nil {
+		t.Error(err)
+	}
+	if _, err := conn.StartTransientUnitContext(ctx, "a-b.slice", "testdelegate", nil, nil); err == nil {
+		t.Error("invalid job modes must be rejected")
+	}
+
+	s.Close()
+	if _, err := s.Conn(); err == nil {
+		t.Error("a closed server must not accept connections")
+	}
+}